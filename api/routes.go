@@ -4,12 +4,52 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+
+	"github.com/icook/tiny-congress/finality"
+	"github.com/icook/tiny-congress/mempool"
 )
 
-func registerRoutes(r gin.IRouter) {
+func registerRoutes(r gin.IRouter, mp *mempool.BallotMempool, chain *finality.Chain) {
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "pong",
 		})
 	})
+	if mp != nil {
+		r.POST("/ballot", ballotHandler(mp))
+	}
+	if chain != nil {
+		r.GET("/finality/head", finalityHeadHandler(chain))
+	}
+}
+
+// finalityHeadHandler reports the chain's finalized tip - not its proposed
+// tip, since an unfinalized block could still be reorged away.
+func finalityHeadHandler(chain *finality.Chain) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		head, ok := chain.Head()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no finalized block yet"})
+			return
+		}
+		c.JSON(http.StatusOK, head)
+	}
+}
+
+// ballotHandler is the hook the ballot mempool is meant to be fed through:
+// a future gossip layer should call mp.Ingest the same way, so every ballot
+// goes through the same verify/dedup pipeline regardless of how it arrived.
+func ballotHandler(mp *mempool.BallotMempool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ballot mempool.Ballot
+		if err := c.ShouldBindJSON(&ballot); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := mp.Ingest(ballot); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "accepted"})
+	}
 }
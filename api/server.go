@@ -4,14 +4,25 @@ import (
 	"context"
 
 	"github.com/gin-gonic/gin"
+
+	"github.com/icook/tiny-congress/finality"
+	"github.com/icook/tiny-congress/mempool"
 )
 
 type APIConfig struct {
 	APIEndpoint string
+
+	// Mempool, if set, feeds the /ballot endpoint; leaving it nil disables
+	// that route instead of serving it against nothing.
+	Mempool *mempool.BallotMempool
+
+	// FinalityChain, if set, feeds the /finality/head endpoint; leaving it
+	// nil disables that route instead of serving it against nothing.
+	FinalityChain *finality.Chain
 }
 
 func Serve(ctx context.Context, cfg APIConfig) error {
 	r := gin.Default()
-	registerRoutes(r)
+	registerRoutes(r, cfg.Mempool, cfg.FinalityChain)
 	return r.Run(cfg.APIEndpoint)
 }
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"sync"
 )
 
 // The data storage layer. Ideally I think I would like to be able to use Redis, postgres, leveldb, or raw json text files
@@ -10,6 +12,47 @@ type StorageDriver interface {
 	GetKey(key string) ([]byte, error)
 }
 
+// ResourceVersion is an opaque, monotonically increasing stamp a
+// StorageDriver attaches to a key every time it is written. It is the basis
+// for optimistic-concurrency updates via GuaranteedUpdate.
+type ResourceVersion uint64
+
+// CASDriver is implemented by storage drivers that can report the current
+// revision of a key and perform an atomic compare-and-swap against it.
+// Drivers that only satisfy StorageDriver fall back to
+// defaultCompareAndSwap, which serializes the read-modify-write under a
+// per-key lock instead.
+type CASDriver interface {
+	StorageDriver
+
+	// GetKeyWithRevision behaves like GetKey but also returns the revision
+	// the returned bytes were written at. A key that doesn't exist yet
+	// reports (nil, 0, nil) rather than an error, since GuaranteedUpdate
+	// treats a missing key as a valid starting point for mutate.
+	GetKeyWithRevision(key string) ([]byte, ResourceVersion, error)
+
+	// CompareAndSwap writes data at key only if the key's current revision
+	// equals expectedRev, and tags the write with newRev. It reports
+	// (false, nil) on a revision mismatch rather than an error.
+	CompareAndSwap(key string, expectedRev, newRev ResourceVersion, data []byte) (bool, error)
+}
+
+// NotFoundChecker lets a plain StorageDriver (one without CASDriver)
+// distinguish "key doesn't exist" from a real error, so GuaranteedUpdate's
+// fallback path can treat a missing key the same way CASDriver.
+// GetKeyWithRevision does: as a nil starting value rather than a failure.
+type NotFoundChecker interface {
+	ErrIsNotFound(error) bool
+}
+
+// ErrGuaranteedUpdateConflict is returned by GuaranteedUpdate when mutate's
+// output keeps losing the compare-and-swap race to concurrent writers.
+var ErrGuaranteedUpdateConflict = errors.New("db: exhausted retries racing concurrent writers")
+
+// maxGuaranteedUpdateRetries bounds the read-mutate-CAS loop so a hot key
+// under heavy contention fails loudly instead of retrying forever.
+const maxGuaranteedUpdateRetries = 10
+
 type TypeEngine interface {
 	GetRuleset(typeCode string) TypeRuleset
 }
@@ -18,13 +61,28 @@ type TypeRuleset interface {
 	MaySet(newValue string) error
 }
 
+// Preconditions lets a caller that already holds a current copy of a key
+// (e.g. from a prior FetchKey) skip GuaranteedUpdate's initial read and go
+// straight to the compare-and-swap attempt.
+type Preconditions struct {
+	UID             string
+	ResourceVersion ResourceVersion
+}
+
 type PersistenceLayer struct {
 	d StorageDriver
 	t TypeEngine
+
+	// casLocks and fallbackRevs back defaultCompareAndSwap for drivers that
+	// don't implement CASDriver themselves: one lock per key plus an
+	// in-process revision counter, both guarded by mu.
+	mu           sync.Mutex
+	casLocks     map[string]*sync.Mutex
+	fallbackRevs map[string]ResourceVersion
 }
 
 func NewPersistenceLayer(d StorageDriver, t TypeEngine) (*PersistenceLayer, error) {
-	return &PersistenceLayer{d: d, t: t}, nil
+	return &PersistenceLayer{d: d, t: t, casLocks: map[string]*sync.Mutex{}}, nil
 }
 
 type Identifier interface {
@@ -38,7 +96,7 @@ type Object interface {
 	Identifiers() []Identifier
 }
 
-func (p PersistenceLayer) UpdateKey(identifier Identifier, key string, value string, valueType string) error {
+func (p *PersistenceLayer) UpdateKey(identifier Identifier, key string, value string, valueType string) error {
 	ruleset := p.t.GetRuleset(valueType)
 	// Validate format of new value against type system
 	if err := ruleset.MaySet(value); err != nil {
@@ -54,6 +112,177 @@ func (p PersistenceLayer) UpdateKey(identifier Identifier, key string, value str
 }
 
 // TODO: consider that perhaps valueType should be an Identifier?
-func (p PersistenceLayer) FetchKey(identifier Identifier, valueType string) (Object, error) {
+func (p *PersistenceLayer) FetchKey(identifier Identifier, valueType string) (Object, error) {
 	return nil, nil
 }
+
+// FetchRaw returns the raw bytes stored for identifier/valueType along with
+// their current revision, bypassing TypeRuleset validation. It's meant for
+// callers storing opaque blobs under their own key scheme - e.g. the wasm
+// runtime loading compiled module bytecode - that need revision info to
+// detect a hot upgrade but have no "current value" to validate against.
+func (p *PersistenceLayer) FetchRaw(identifier Identifier, valueType string) ([]byte, ResourceVersion, error) {
+	keyName := fmt.Sprintf("%s.%s#%s", valueType, identifier.Name(), identifier.Key())
+	return p.getKeyWithRevision(keyName)
+}
+
+// WriteRaw is FetchRaw's write-side counterpart: it writes data for
+// identifier/valueType directly through the storage driver, bypassing
+// TypeRuleset.MaySet. UpdateKey's ruleset validation is for values the type
+// system governs; internal bookkeeping a component persists about itself -
+// a round checkpoint, a finality snapshot - was never declared to a
+// TypeEngine and has no ruleset to validate against, so routing it through
+// UpdateKey either panics (a TypeEngine that rejects unknown valueTypes
+// outright) or silently depends on every TypeEngine happening to allow it.
+func (p *PersistenceLayer) WriteRaw(identifier Identifier, valueType string, data []byte) error {
+	keyName := fmt.Sprintf("%s.%s#%s", valueType, identifier.Name(), identifier.Key())
+	return p.d.WriteKey(keyName, data)
+}
+
+// GuaranteedUpdate performs a read-modify-write against the key backing
+// identifier/valueType. mutate is handed the current bytes (nil if the key
+// doesn't exist yet) plus the revision they were read at, and must return
+// the next bytes to write. If a concurrent writer wins the race, mutate is
+// re-invoked against freshly re-read data until it succeeds or
+// ErrGuaranteedUpdateConflict is returned.
+//
+// This is the pattern etcd/the k8s apiserver use for safe read-modify-write
+// against a shared key - it's the only way to do things like trust graph,
+// ballot, or workflow-state mutations without racing another writer.
+func (p *PersistenceLayer) GuaranteedUpdate(identifier Identifier, valueType string, mutate func(current []byte, res ResourceVersion) ([]byte, error)) error {
+	keyName := fmt.Sprintf("%s.%s#%s", valueType, identifier.Name(), identifier.Key())
+	return p.guaranteedUpdate(keyName, valueType, nil, mutate)
+}
+
+// GuaranteedUpdateWithPreconditions is GuaranteedUpdate for a caller that
+// already has a current copy of the key (e.g. from a prior FetchKey): the
+// initial read is skipped and pre is used as the starting point, only
+// falling back to a fresh read if the first CAS attempt loses the race.
+func (p *PersistenceLayer) GuaranteedUpdateWithPreconditions(identifier Identifier, valueType string, current []byte, pre Preconditions, mutate func(current []byte, res ResourceVersion) ([]byte, error)) error {
+	keyName := fmt.Sprintf("%s.%s#%s", valueType, identifier.Name(), identifier.Key())
+	return p.guaranteedUpdate(keyName, valueType, &cachedRead{data: current, rev: pre.ResourceVersion}, mutate)
+}
+
+type cachedRead struct {
+	data []byte
+	rev  ResourceVersion
+}
+
+func (p *PersistenceLayer) guaranteedUpdate(keyName, valueType string, seed *cachedRead, mutate func([]byte, ResourceVersion) ([]byte, error)) error {
+	ruleset := p.t.GetRuleset(valueType)
+
+	var current []byte
+	var rev ResourceVersion
+	mustCheckData := true
+	if seed != nil {
+		current, rev = seed.data, seed.rev
+		mustCheckData = false
+	}
+
+	for attempt := 0; attempt < maxGuaranteedUpdateRetries; attempt++ {
+		if mustCheckData {
+			var err error
+			current, rev, err = p.getKeyWithRevision(keyName)
+			if err != nil {
+				return err
+			}
+			mustCheckData = false
+		}
+
+		next, err := mutate(current, rev)
+		if err != nil {
+			return err
+		}
+		if err := ruleset.MaySet(string(next)); err != nil {
+			return err
+		}
+
+		ok, err := p.compareAndSwap(keyName, rev, rev+1, next)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		// Lost the race - a stale cache (including a caller-supplied
+		// Preconditions) can't be trusted anymore, so force a re-read.
+		mustCheckData = true
+	}
+	return ErrGuaranteedUpdateConflict
+}
+
+func (p *PersistenceLayer) getKeyWithRevision(keyName string) ([]byte, ResourceVersion, error) {
+	if cd, ok := p.d.(CASDriver); ok {
+		return cd.GetKeyWithRevision(keyName)
+	}
+	data, err := p.d.GetKey(keyName)
+	if err != nil {
+		if nf, ok := p.d.(NotFoundChecker); ok && nf.ErrIsNotFound(err) {
+			return nil, p.fallbackRevision(keyName), nil
+		}
+		return nil, 0, err
+	}
+	return data, p.fallbackRevision(keyName), nil
+}
+
+func (p *PersistenceLayer) compareAndSwap(keyName string, expectedRev, newRev ResourceVersion, data []byte) (bool, error) {
+	if cd, ok := p.d.(CASDriver); ok {
+		return cd.CompareAndSwap(keyName, expectedRev, newRev, data)
+	}
+	return p.defaultCompareAndSwap(keyName, expectedRev, newRev, data)
+}
+
+// defaultCompareAndSwap backs GuaranteedUpdate for drivers that only
+// implement plain WriteKey/GetKey: it serializes the whole
+// read-compare-write sequence under a per-key lock so no other caller of
+// this PersistenceLayer can interleave, then tracks the "revision" as an
+// in-process counter since the underlying driver has no notion of one.
+func (p *PersistenceLayer) defaultCompareAndSwap(keyName string, expectedRev, newRev ResourceVersion, data []byte) (bool, error) {
+	lock := p.lockFor(keyName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if p.fallbackRevision(keyName) != expectedRev {
+		return false, nil
+	}
+	if err := p.d.WriteKey(keyName, data); err != nil {
+		return false, err
+	}
+	p.setFallbackRevision(keyName, newRev)
+	return true, nil
+}
+
+func (p *PersistenceLayer) lockFor(keyName string) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lock, ok := p.casLocks[keyName]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.casLocks[keyName] = lock
+	}
+	return lock
+}
+
+// fallbackRevision/setFallbackRevision track revisions client-side for
+// drivers that don't implement CASDriver. They keep their own fallbackRevs
+// map but share lockFor's mutex (p.mu), since both only matter for
+// non-CASDriver drivers.
+func (p *PersistenceLayer) fallbackRevision(keyName string) ResourceVersion {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fallbackRevisions()[keyName]
+}
+
+func (p *PersistenceLayer) setFallbackRevision(keyName string, rev ResourceVersion) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fallbackRevisions()[keyName] = rev
+}
+
+// fallbackRevisions lazily initializes the revision map. Callers must hold p.mu.
+func (p *PersistenceLayer) fallbackRevisions() map[string]ResourceVersion {
+	if p.fallbackRevs == nil {
+		p.fallbackRevs = map[string]ResourceVersion{}
+	}
+	return p.fallbackRevs
+}
@@ -0,0 +1,563 @@
+// Package finality maintains an append-only chain of FinalityBlocks and
+// decides which of them are finalized via a GRANDPA-inspired two-phase vote
+// (prevote, then precommit) among a token-weighted validator set. Elections
+// reach ElectionStatusRatified in isolation; this package is what lets a
+// client treat that result as part of a canonical, un-reorgable history.
+package finality
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/icook/tiny-congress/db"
+	"github.com/icook/tiny-congress/identity"
+)
+
+// ElectionID identifies an election whose ratification a FinalityBlock is
+// recording.
+type ElectionID string
+
+// BlockHash is a FinalityBlock's content hash, and what prevotes/precommits
+// are cast for.
+type BlockHash [32]byte
+
+// FinalityBlock is one link in the chain: the elections ratified since its
+// parent, chained by hash rather than by height alone so a fork can never
+// be mistaken for a continuation.
+type FinalityBlock struct {
+	Height            uint64
+	ParentHash        BlockHash
+	RatifiedElections []ElectionID
+	Timestamp         time.Time
+}
+
+// Hash deterministically identifies this block's content.
+func (b FinalityBlock) Hash() BlockHash {
+	data, err := json.Marshal(struct {
+		Height            uint64       `json:"height"`
+		ParentHash        BlockHash    `json:"parent_hash"`
+		RatifiedElections []ElectionID `json:"ratified_elections"`
+		Timestamp         int64        `json:"timestamp"`
+	}{b.Height, b.ParentHash, b.RatifiedElections, b.Timestamp.UnixNano()})
+	if err != nil {
+		// The fields above are all marshalable primitives - this can't happen.
+		panic(fmt.Sprintf("finality: hashing block: %v", err))
+	}
+	return sha256.Sum256(data)
+}
+
+// Validator is one member of the finality voting set: a user and the
+// token-weight their grant gives them.
+type Validator struct {
+	UserID identity.UserID
+	Weight float64
+}
+
+// ValidatorSet resolves the current voting set for a Chain. A caller
+// typically derives one from identity.IdentityNetwork token grants - see
+// ValidatorsFromGrants - but it's a plain function so the set can be
+// refreshed between rounds without the Chain needing to know how.
+type ValidatorSet func() []Validator
+
+// ValidatorsFromGrants builds a ValidatorSet out of token grants, keeping
+// only the ones for tokenType and weighting each validator by the sum of
+// their TokenQuantity across every matching grant - the designated
+// TokenType's holders are the voting set. Grants are aggregated per UserID
+// rather than kept one-Validator-per-grant, since nothing stops the same
+// user holding more than one grant of the same TokenType, and a
+// per-grant Validator for each would let that user's weight be
+// double-counted everywhere totalWeight/weightFor sum the set.
+func ValidatorsFromGrants(network identity.IdentityNetwork, grants []identity.UserGrant, tokenType string) ValidatorSet {
+	return func() []Validator {
+		var order []identity.UserID
+		weightByUser := make(map[identity.UserID]float64)
+		for _, g := range grants {
+			if g.TokenType != tokenType {
+				continue
+			}
+			if _, ok := network.Users[g.UserID]; !ok {
+				continue
+			}
+			if _, ok := weightByUser[g.UserID]; !ok {
+				order = append(order, g.UserID)
+			}
+			weightByUser[g.UserID] += g.TokenQuantity
+		}
+
+		var out []Validator
+		for _, userID := range order {
+			out = append(out, Validator{UserID: userID, Weight: weightByUser[userID]})
+		}
+		return out
+	}
+}
+
+// KeyResolver looks up the key a validator's prevote/precommit is signed
+// with, mirroring the DI pattern mempool.KeyResolver uses to stand in for
+// identity.UserKeychain.AuthorizedKeys(), which isn't implemented yet.
+type KeyResolver func(validator identity.UserID) (identity.AuthorizedKey, bool)
+
+// FinalityProof is the aggregated precommit evidence behind a finalized
+// block - enough for a client to verify finality itself rather than trust
+// the chain's own bookkeeping.
+type FinalityProof struct {
+	Height     uint64
+	BlockHash  BlockHash
+	Signatures map[identity.UserID][]byte
+}
+
+// ErrEquivocation is returned when a validator casts conflicting votes (for
+// different block hashes) at the same height and phase. The validator's
+// vote is discarded from that height's tally entirely rather than counted
+// for either side.
+type ErrEquivocation struct {
+	Height    uint64
+	Phase     string
+	Validator identity.UserID
+}
+
+func (e ErrEquivocation) Error() string {
+	return fmt.Sprintf("finality: validator %s equivocated in %s at height %d", uuid.UUID(e.Validator), e.Phase, e.Height)
+}
+
+type votePhase string
+
+const (
+	phasePrevote   votePhase = "prevote"
+	phasePrecommit votePhase = "precommit"
+)
+
+func votePayload(phase votePhase, height uint64, hash BlockHash) []byte {
+	return []byte(fmt.Sprintf("%s:%d:%x", phase, height, hash))
+}
+
+// phaseTally tracks one height's votes for a single phase (prevote or
+// precommit), and the validators caught equivocating within it.
+type phaseTally struct {
+	votes        map[identity.UserID]BlockHash
+	equivocators map[identity.UserID]bool
+}
+
+// record adds validator's vote for hash, reporting true (and discarding the
+// vote) if this conflicts with a vote validator already cast at this
+// height/phase.
+func (t *phaseTally) record(validator identity.UserID, hash BlockHash) bool {
+	if t.equivocators == nil {
+		t.equivocators = map[identity.UserID]bool{}
+	}
+	if t.equivocators[validator] {
+		return true
+	}
+	if t.votes == nil {
+		t.votes = map[identity.UserID]BlockHash{}
+	}
+	if existing, ok := t.votes[validator]; ok && existing != hash {
+		delete(t.votes, validator)
+		t.equivocators[validator] = true
+		return true
+	}
+	t.votes[validator] = hash
+	return false
+}
+
+func (t *phaseTally) weightFor(hash BlockHash, validators []Validator) float64 {
+	var sum float64
+	for _, v := range validators {
+		if voted, ok := t.votes[v.UserID]; ok && voted == hash {
+			sum += v.Weight
+		}
+	}
+	return sum
+}
+
+func totalWeight(validators []Validator) float64 {
+	var sum float64
+	for _, v := range validators {
+		sum += v.Weight
+	}
+	return sum
+}
+
+// hasSupermajority reports whether weight is a strict majority greater than
+// two thirds of total - GRANDPA's finality threshold.
+func hasSupermajority(weight, total float64) bool {
+	return weight*3 > total*2
+}
+
+// chainIdentifier satisfies db.Identifier for a chain's persisted snapshot.
+type chainIdentifier struct{ chainID string }
+
+func (c chainIdentifier) Pairs() map[string]string { return map[string]string{"chain": c.chainID} }
+func (c chainIdentifier) Key() string              { return c.chainID }
+func (c chainIdentifier) Name() string             { return "finality" }
+
+// persistedChain is the JSON snapshot a Chain is stored as through the
+// db.PersistenceLayer, under the key "finality_chain.finality#<chainID>", so
+// a restarted process can rebuild its in-memory state instead of starting
+// from an empty chain. The key has no "/finality/" path prefix.
+type persistedChain struct {
+	Blocks       []FinalityBlock  `json:"blocks"`
+	Head         uint64           `json:"head"`
+	HasHead      bool             `json:"has_head"`
+	Finalized    uint64           `json:"finalized"`
+	HasFinalized bool             `json:"has_finalized"`
+	Proofs       []persistedProof `json:"proofs"`
+}
+
+// persistedProof is FinalityProof flattened for JSON: identity.UserID is a
+// [16]byte array, which encoding/json refuses to use as a map key, so the
+// signature set is stored as a slice of entries instead.
+type persistedProof struct {
+	Height     uint64           `json:"height"`
+	BlockHash  BlockHash        `json:"block_hash"`
+	Signatures []signatureEntry `json:"signatures"`
+}
+
+type signatureEntry struct {
+	Validator identity.UserID `json:"validator"`
+	Signature []byte          `json:"signature"`
+}
+
+func toPersistedProof(proof FinalityProof) persistedProof {
+	entries := make([]signatureEntry, 0, len(proof.Signatures))
+	for validator, sig := range proof.Signatures {
+		entries = append(entries, signatureEntry{Validator: validator, Signature: sig})
+	}
+	return persistedProof{Height: proof.Height, BlockHash: proof.BlockHash, Signatures: entries}
+}
+
+func fromPersistedProof(p persistedProof) FinalityProof {
+	sigs := make(map[identity.UserID][]byte, len(p.Signatures))
+	for _, entry := range p.Signatures {
+		sigs[entry.Validator] = entry.Signature
+	}
+	return FinalityProof{Height: p.Height, BlockHash: p.BlockHash, Signatures: sigs}
+}
+
+// Chain is an append-only sequence of FinalityBlocks plus the prevote and
+// precommit tallies deciding which of them are finalized. Finalization only
+// ever advances the chain one block at a time - Precommit refuses to
+// finalize a block whose parent isn't already finalized - so "finalizing
+// height N implicitly finalizes all ancestors" holds by construction rather
+// than needing an explicit backward walk.
+type Chain struct {
+	store      *db.PersistenceLayer
+	chainID    string
+	validators ValidatorSet
+	resolveKey KeyResolver
+
+	mu sync.Mutex
+
+	blocks   map[BlockHash]FinalityBlock
+	byHeight map[uint64]BlockHash
+	head     uint64
+	hasHead  bool
+	headHash BlockHash
+
+	finalized     uint64
+	hasFinalized  bool
+	finalizedHash BlockHash
+	byElection    map[ElectionID]uint64
+	proofs        map[uint64]FinalityProof
+
+	prevotes             map[uint64]*phaseTally
+	precommits           map[uint64]*phaseTally
+	precommitSignatures  map[uint64]map[identity.UserID][]byte
+	prevoteSupermajority map[uint64]BlockHash
+
+	subscribers []chan FinalityBlock
+}
+
+// NewChain builds a Chain named chainID, restoring its state from store if
+// a snapshot was persisted there by an earlier process. store may be nil
+// for a purely in-memory chain (e.g. in tests).
+func NewChain(store *db.PersistenceLayer, chainID string, validators ValidatorSet, resolveKey KeyResolver) (*Chain, error) {
+	c := &Chain{
+		store:                store,
+		chainID:              chainID,
+		validators:           validators,
+		resolveKey:           resolveKey,
+		blocks:               map[BlockHash]FinalityBlock{},
+		byHeight:             map[uint64]BlockHash{},
+		byElection:           map[ElectionID]uint64{},
+		proofs:               map[uint64]FinalityProof{},
+		prevotes:             map[uint64]*phaseTally{},
+		precommits:           map[uint64]*phaseTally{},
+		precommitSignatures:  map[uint64]map[identity.UserID][]byte{},
+		prevoteSupermajority: map[uint64]BlockHash{},
+	}
+	if store == nil {
+		return c, nil
+	}
+
+	data, _, err := store.FetchRaw(chainIdentifier{chainID: chainID}, "finality_chain")
+	if err != nil {
+		return nil, errors.Wrapf(err, "finality: loading chain %q", chainID)
+	}
+	if len(data) == 0 {
+		return c, nil
+	}
+
+	var snapshot persistedChain
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, errors.Wrapf(err, "finality: decoding persisted chain %q", chainID)
+	}
+	for _, block := range snapshot.Blocks {
+		hash := block.Hash()
+		c.blocks[hash] = block
+		c.byHeight[block.Height] = hash
+		if snapshot.HasFinalized && block.Height <= snapshot.Finalized {
+			for _, electionID := range block.RatifiedElections {
+				c.byElection[electionID] = block.Height
+			}
+		}
+	}
+	c.head, c.hasHead = snapshot.Head, snapshot.HasHead
+	if c.hasHead {
+		c.headHash = c.byHeight[c.head]
+	}
+	c.finalized, c.hasFinalized = snapshot.Finalized, snapshot.HasFinalized
+	if c.hasFinalized {
+		c.finalizedHash = c.byHeight[c.finalized]
+	}
+	for _, proof := range snapshot.Proofs {
+		c.proofs[proof.Height] = fromPersistedProof(proof)
+	}
+	return c, nil
+}
+
+// Propose appends a new block recording ratifiedElections, chained from the
+// current head. It doesn't itself finalize anything - that's decided by
+// Prevote/Precommit below.
+func (c *Chain) Propose(ratifiedElections []ElectionID) FinalityBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var parent BlockHash
+	height := uint64(0)
+	if c.hasHead {
+		parent = c.headHash
+		height = c.head + 1
+	}
+	block := FinalityBlock{
+		Height:            height,
+		ParentHash:        parent,
+		RatifiedElections: append([]ElectionID(nil), ratifiedElections...),
+		Timestamp:         time.Now(),
+	}
+	hash := block.Hash()
+	c.blocks[hash] = block
+	c.byHeight[height] = hash
+	c.head, c.hasHead, c.headHash = height, true, hash
+
+	c.persist()
+	return block
+}
+
+// Prevote records validator's signed prevote for hash at height. Once
+// prevotes covering more than two thirds of validator weight agree on a
+// hash at this height, that hash becomes eligible for precommits.
+func (c *Chain) Prevote(height uint64, hash BlockHash, validator identity.UserID, signature []byte) error {
+	if err := c.verifyVote(phasePrevote, height, hash, validator, signature); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tally := c.prevotes[height]
+	if tally == nil {
+		tally = &phaseTally{}
+		c.prevotes[height] = tally
+	}
+	if tally.record(validator, hash) {
+		return ErrEquivocation{Height: height, Phase: string(phasePrevote), Validator: validator}
+	}
+
+	validators := c.validators()
+	if hasSupermajority(tally.weightFor(hash, validators), totalWeight(validators)) {
+		c.prevoteSupermajority[height] = hash
+	}
+	return nil
+}
+
+// Precommit records validator's signed precommit for hash at height. A
+// precommit is only accepted for a hash that has already cleared a prevote
+// supermajority at this height - the "prevote round, then precommit round"
+// GRANDPA structure. Once precommits covering more than two thirds of
+// validator weight agree, the block finalizes.
+func (c *Chain) Precommit(height uint64, hash BlockHash, validator identity.UserID, signature []byte) error {
+	if err := c.verifyVote(phasePrecommit, height, hash, validator, signature); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prevoted, ok := c.prevoteSupermajority[height]
+	if !ok || prevoted != hash {
+		return fmt.Errorf("finality: no prevote supermajority for block %x at height %d yet", hash, height)
+	}
+
+	tally := c.precommits[height]
+	if tally == nil {
+		tally = &phaseTally{}
+		c.precommits[height] = tally
+	}
+	if tally.record(validator, hash) {
+		return ErrEquivocation{Height: height, Phase: string(phasePrecommit), Validator: validator}
+	}
+
+	sigs := c.precommitSignatures[height]
+	if sigs == nil {
+		sigs = map[identity.UserID][]byte{}
+		c.precommitSignatures[height] = sigs
+	}
+	sigs[validator] = signature
+
+	validators := c.validators()
+	if !hasSupermajority(tally.weightFor(hash, validators), totalWeight(validators)) {
+		return nil
+	}
+
+	proof := FinalityProof{Height: height, BlockHash: hash, Signatures: copySignatures(sigs)}
+	return c.finalizeLocked(height, hash, proof)
+}
+
+// finalizeLocked applies a just-reached precommit supermajority. Callers
+// must hold c.mu.
+func (c *Chain) finalizeLocked(height uint64, hash BlockHash, proof FinalityProof) error {
+	block, ok := c.blocks[hash]
+	if !ok {
+		return fmt.Errorf("finality: unknown block %x at height %d", hash, height)
+	}
+	if c.hasFinalized {
+		if height != c.finalized+1 || block.ParentHash != c.finalizedHash {
+			return fmt.Errorf("finality: refusing to finalize height %d before its parent is finalized", height)
+		}
+	} else if height != 0 {
+		return fmt.Errorf("finality: refusing to finalize height %d before genesis is finalized", height)
+	}
+
+	c.finalized, c.hasFinalized, c.finalizedHash = height, true, hash
+	c.proofs[height] = proof
+	for _, electionID := range block.RatifiedElections {
+		c.byElection[electionID] = height
+	}
+
+	c.persist()
+	c.publish(block)
+	return nil
+}
+
+func copySignatures(sigs map[identity.UserID][]byte) map[identity.UserID][]byte {
+	out := make(map[identity.UserID][]byte, len(sigs))
+	for id, sig := range sigs {
+		out[id] = sig
+	}
+	return out
+}
+
+// Finalized reports the FinalityProof behind electionID's block, if that
+// block has been finalized.
+func (c *Chain) Finalized(electionID ElectionID) (FinalityProof, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	height, ok := c.byElection[electionID]
+	if !ok {
+		return FinalityProof{}, false
+	}
+	proof, ok := c.proofs[height]
+	return proof, ok
+}
+
+// Head returns the chain's finalized tip, if anything has been finalized
+// yet. This backs the /finality/head endpoint - it's deliberately the
+// finalized head, not the proposed tip, since an unfinalized block could
+// still be reorged away.
+func (c *Chain) Head() (FinalityBlock, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.hasFinalized {
+		return FinalityBlock{}, false
+	}
+	return c.blocks[c.finalizedHash], true
+}
+
+// SubscribeFinality returns a channel that receives every block as it
+// finalizes. The channel is buffered; a subscriber that falls behind misses
+// blocks rather than stalling finalization.
+func (c *Chain) SubscribeFinality() <-chan FinalityBlock {
+	ch := make(chan FinalityBlock, 16)
+	c.mu.Lock()
+	c.subscribers = append(c.subscribers, ch)
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *Chain) publish(block FinalityBlock) {
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- block:
+		default:
+		}
+	}
+}
+
+func (c *Chain) verifyVote(phase votePhase, height uint64, hash BlockHash, validator identity.UserID, signature []byte) error {
+	key, ok := c.resolveKey(validator)
+	if !ok {
+		return fmt.Errorf("finality: no authorized key for validator %s", uuid.UUID(validator))
+	}
+	if len(key.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(key.PublicKey), votePayload(phase, height, hash), signature) {
+		return fmt.Errorf("finality: invalid %s signature from validator %s at height %d", phase, uuid.UUID(validator), height)
+	}
+	return nil
+}
+
+// persist snapshots the chain to store. Best-effort, like
+// election.Engine.persistRound: a failure here degrades restart recovery
+// rather than aborting an otherwise-healthy chain. It writes through
+// WriteRaw rather than UpdateKey since this snapshot is our own internal
+// bookkeeping, not a type-governed value - it was never declared to a
+// TypeEngine and has no ruleset to validate against.
+func (c *Chain) persist() {
+	if c.store == nil {
+		return
+	}
+	var blocks []FinalityBlock
+	if c.hasHead {
+		blocks = make([]FinalityBlock, 0, c.head+1)
+		for h := uint64(0); h <= c.head; h++ {
+			if hash, ok := c.byHeight[h]; ok {
+				blocks = append(blocks, c.blocks[hash])
+			}
+		}
+	}
+	proofs := make([]persistedProof, 0, len(c.proofs))
+	for _, proof := range c.proofs {
+		proofs = append(proofs, toPersistedProof(proof))
+	}
+	snapshot := persistedChain{
+		Blocks:       blocks,
+		Head:         c.head,
+		HasHead:      c.hasHead,
+		Finalized:    c.finalized,
+		HasFinalized: c.hasFinalized,
+		Proofs:       proofs,
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return
+	}
+	_ = c.store.WriteRaw(chainIdentifier{chainID: c.chainID}, "finality_chain", data)
+}
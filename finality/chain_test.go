@@ -0,0 +1,286 @@
+package finality
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/icook/tiny-congress/db"
+	"github.com/icook/tiny-congress/identity"
+	"github.com/icook/tiny-congress/storage/mem"
+)
+
+// unregisteredTypeEngine models a realistic db.TypeEngine: one that has
+// never heard of "finality_chain" and refuses to guess at a ruleset for it.
+// The Chain's persistence never declares a TypeEngine ruleset for its own
+// bookkeeping, so it must go through db.PersistenceLayer.WriteRaw rather
+// than UpdateKey - this engine panics if that assumption is ever violated.
+type unregisteredTypeEngine struct{}
+
+func (unregisteredTypeEngine) GetRuleset(valueType string) db.TypeRuleset {
+	panic(fmt.Sprintf("no ruleset registered for valueType %q", valueType))
+}
+
+func newTestStore(t *testing.T) *db.PersistenceLayer {
+	t.Helper()
+	store, err := db.NewPersistenceLayer(mem.NewMemStore(), unregisteredTypeEngine{})
+	if err != nil {
+		t.Fatalf("NewPersistenceLayer: %v", err)
+	}
+	return store
+}
+
+// fourValidators returns 4 equal-weight validators plus a resolver and
+// signer keyed by validator ID, so callers can both build a ValidatorSet
+// and sign votes on their behalf.
+func fourValidators(t *testing.T) ([]Validator, KeyResolver, map[identity.UserID]ed25519.PrivateKey) {
+	t.Helper()
+	validators := make([]Validator, 4)
+	keys := map[identity.UserID]identity.AuthorizedKey{}
+	privs := map[identity.UserID]ed25519.PrivateKey{}
+	for i := range validators {
+		pub, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("ed25519.GenerateKey: %v", err)
+		}
+		id := identity.UserID(uuid.New())
+		validators[i] = Validator{UserID: id, Weight: 1}
+		keys[id] = identity.AuthorizedKey{PublicKey: pub}
+		privs[id] = priv
+	}
+	resolver := func(id identity.UserID) (identity.AuthorizedKey, bool) {
+		key, ok := keys[id]
+		return key, ok
+	}
+	return validators, resolver, privs
+}
+
+func sign(priv ed25519.PrivateKey, phase votePhase, height uint64, hash BlockHash) []byte {
+	return ed25519.Sign(priv, votePayload(phase, height, hash))
+}
+
+func TestChainFinalizesOnlyAtTwoThirdsThreshold(t *testing.T) {
+	validators, resolver, privs := fourValidators(t)
+	chain, err := NewChain(nil, "test", func() []Validator { return validators }, resolver)
+	if err != nil {
+		t.Fatalf("NewChain: %v", err)
+	}
+
+	sub := chain.SubscribeFinality()
+
+	block := chain.Propose([]ElectionID{"election-1"})
+	hash := block.Hash()
+
+	// 3 of 4 equal-weight prevotes clears the prevote supermajority
+	// (weight 3, 3*3=9 > 4*2=8).
+	for i := 0; i < 3; i++ {
+		id := validators[i].UserID
+		if err := chain.Prevote(block.Height, hash, id, sign(privs[id], phasePrevote, block.Height, hash)); err != nil {
+			t.Fatalf("Prevote(%d): %v", i, err)
+		}
+	}
+
+	// 2 of 4 precommits (weight 2, 2*3=6 <= 8) must not finalize yet.
+	for i := 0; i < 2; i++ {
+		id := validators[i].UserID
+		if err := chain.Precommit(block.Height, hash, id, sign(privs[id], phasePrecommit, block.Height, hash)); err != nil {
+			t.Fatalf("Precommit(%d): %v", i, err)
+		}
+	}
+	if _, ok := chain.Head(); ok {
+		t.Fatal("expected no finalized head before the precommit supermajority is reached")
+	}
+
+	// The 3rd precommit (weight 3) crosses the threshold and finalizes.
+	id := validators[2].UserID
+	if err := chain.Precommit(block.Height, hash, id, sign(privs[id], phasePrecommit, block.Height, hash)); err != nil {
+		t.Fatalf("Precommit(2): %v", err)
+	}
+
+	head, ok := chain.Head()
+	if !ok || head.Height != block.Height {
+		t.Fatalf("expected block at height %d to be finalized, got %+v ok=%v", block.Height, head, ok)
+	}
+
+	proof, ok := chain.Finalized("election-1")
+	if !ok {
+		t.Fatal("expected election-1 to be finalized")
+	}
+	if len(proof.Signatures) != 3 {
+		t.Fatalf("expected 3 aggregated precommit signatures, got %d", len(proof.Signatures))
+	}
+
+	select {
+	case finalized := <-sub:
+		if finalized.Height != block.Height {
+			t.Fatalf("expected subscriber to observe height %d, got %d", block.Height, finalized.Height)
+		}
+	default:
+		t.Fatal("expected a finality notification on the subscriber channel")
+	}
+}
+
+func TestChainPrecommitRejectedWithoutPrevoteSupermajority(t *testing.T) {
+	validators, resolver, privs := fourValidators(t)
+	chain, err := NewChain(nil, "test", func() []Validator { return validators }, resolver)
+	if err != nil {
+		t.Fatalf("NewChain: %v", err)
+	}
+
+	block := chain.Propose(nil)
+	hash := block.Hash()
+	id := validators[0].UserID
+
+	err = chain.Precommit(block.Height, hash, id, sign(privs[id], phasePrecommit, block.Height, hash))
+	if err == nil {
+		t.Fatal("expected precommit without a prevote supermajority to be rejected")
+	}
+}
+
+func TestChainDetectsEquivocation(t *testing.T) {
+	validators, resolver, privs := fourValidators(t)
+	chain, err := NewChain(nil, "test", func() []Validator { return validators }, resolver)
+	if err != nil {
+		t.Fatalf("NewChain: %v", err)
+	}
+
+	id := validators[0].UserID
+	var hashA, hashB BlockHash
+	hashA[0], hashB[0] = 0x01, 0x02
+
+	if err := chain.Prevote(5, hashA, id, sign(privs[id], phasePrevote, 5, hashA)); err != nil {
+		t.Fatalf("first Prevote: %v", err)
+	}
+
+	err = chain.Prevote(5, hashB, id, sign(privs[id], phasePrevote, 5, hashB))
+	if _, ok := err.(ErrEquivocation); !ok {
+		t.Fatalf("expected ErrEquivocation prevoting two hashes at the same height, got %v", err)
+	}
+
+	// Once flagged, this validator's vote no longer counts toward either
+	// hash's tally - not even a later repeat of its original vote.
+	err = chain.Prevote(5, hashA, id, sign(privs[id], phasePrevote, 5, hashA))
+	if _, ok := err.(ErrEquivocation); !ok {
+		t.Fatalf("expected the validator to remain flagged as an equivocator, got %v", err)
+	}
+}
+
+func TestChainRefusesToFinalizeBeforeParent(t *testing.T) {
+	validators, resolver, privs := fourValidators(t)
+	chain, err := NewChain(nil, "test", func() []Validator { return validators }, resolver)
+	if err != nil {
+		t.Fatalf("NewChain: %v", err)
+	}
+
+	chain.Propose([]ElectionID{"election-0"})
+	second := chain.Propose([]ElectionID{"election-1"})
+	hash := second.Hash()
+
+	for i := 0; i < 3; i++ {
+		id := validators[i].UserID
+		if err := chain.Prevote(second.Height, hash, id, sign(privs[id], phasePrevote, second.Height, hash)); err != nil {
+			t.Fatalf("Prevote(%d): %v", i, err)
+		}
+	}
+	var precommitErr error
+	for i := 0; i < 3; i++ {
+		id := validators[i].UserID
+		if err := chain.Precommit(second.Height, hash, id, sign(privs[id], phasePrecommit, second.Height, hash)); err != nil {
+			precommitErr = err
+		}
+	}
+	if precommitErr == nil {
+		t.Fatal("expected finalizing height 1 before height 0 is finalized to be refused")
+	}
+	if _, ok := chain.Head(); ok {
+		t.Fatal("expected no finalized head")
+	}
+}
+
+func TestChainRecoversAfterRestart(t *testing.T) {
+	store := newTestStore(t)
+	validators, resolver, privs := fourValidators(t)
+	validatorSet := func() []Validator { return validators }
+
+	chain, err := NewChain(store, "test-chain", validatorSet, resolver)
+	if err != nil {
+		t.Fatalf("NewChain: %v", err)
+	}
+	block := chain.Propose([]ElectionID{"election-1"})
+	hash := block.Hash()
+	for i := 0; i < 3; i++ {
+		id := validators[i].UserID
+		if err := chain.Prevote(block.Height, hash, id, sign(privs[id], phasePrevote, block.Height, hash)); err != nil {
+			t.Fatalf("Prevote(%d): %v", i, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		id := validators[i].UserID
+		if err := chain.Precommit(block.Height, hash, id, sign(privs[id], phasePrecommit, block.Height, hash)); err != nil {
+			t.Fatalf("Precommit(%d): %v", i, err)
+		}
+	}
+	if _, ok := chain.Head(); !ok {
+		t.Fatal("expected block to be finalized before restart")
+	}
+
+	// Simulate a process restart: build a fresh Chain value against the
+	// same store and chain ID, with no in-memory state carried over.
+	restarted, err := NewChain(store, "test-chain", validatorSet, resolver)
+	if err != nil {
+		t.Fatalf("NewChain after restart: %v", err)
+	}
+
+	head, ok := restarted.Head()
+	if !ok || head.Height != block.Height {
+		t.Fatalf("expected the finalized head to survive restart, got %+v ok=%v", head, ok)
+	}
+	if _, ok := restarted.Finalized("election-1"); !ok {
+		t.Fatal("expected election-1's finality proof to survive restart")
+	}
+
+	// And the chain keeps extending correctly from the recovered head.
+	next := restarted.Propose([]ElectionID{"election-2"})
+	if next.Height != block.Height+1 || next.ParentHash != hash {
+		t.Fatalf("expected the recovered chain to extend from the restored head, got %+v", next)
+	}
+}
+
+// TestValidatorsFromGrantsAggregatesDuplicateGrantsPerUser confirms a user
+// holding two grants of the same TokenType gets one Validator entry with
+// their weight summed, rather than two entries that would let their
+// weight be counted twice by totalWeight/weightFor.
+func TestValidatorsFromGrantsAggregatesDuplicateGrantsPerUser(t *testing.T) {
+	userA := identity.UserID(uuid.New())
+	userB := identity.UserID(uuid.New())
+	network := identity.IdentityNetwork{
+		Users: map[identity.UserID]identity.User{
+			userA: {ID: userA},
+			userB: {ID: userB},
+		},
+	}
+	grants := []identity.UserGrant{
+		{UserID: userA, TokenType: "validator", TokenQuantity: 1},
+		{UserID: userB, TokenType: "validator", TokenQuantity: 1},
+		{UserID: userA, TokenType: "validator", TokenQuantity: 2},
+		{UserID: userA, TokenType: "other", TokenQuantity: 100},
+	}
+
+	validators := ValidatorsFromGrants(network, grants, "validator")()
+	if len(validators) != 2 {
+		t.Fatalf("expected one Validator per distinct UserID, got %d: %+v", len(validators), validators)
+	}
+
+	weights := make(map[identity.UserID]float64, len(validators))
+	for _, v := range validators {
+		weights[v.UserID] = v.Weight
+	}
+	if weights[userA] != 3 {
+		t.Fatalf("expected userA's duplicate grants to be summed to 3, got %v", weights[userA])
+	}
+	if weights[userB] != 1 {
+		t.Fatalf("expected userB's weight to be 1, got %v", weights[userB])
+	}
+}
@@ -0,0 +1,475 @@
+// Package mempool ingests signed ballots ahead of election.Engine, so every
+// source - the API's /ballot endpoint, a future gossip layer - feeds the
+// same verify-once/dedupe/reap pipeline instead of writing straight into a
+// round's ballot list.
+package mempool
+
+import (
+	"container/list"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/icook/tiny-congress/db"
+	"github.com/icook/tiny-congress/identity"
+	"github.com/icook/tiny-congress/v1/election"
+)
+
+// DropReason categorizes why Ingest refused a ballot, for metrics.
+type DropReason string
+
+const (
+	DropReasonDuplicate        DropReason = "duplicate"
+	DropReasonCommitted        DropReason = "committed"
+	DropReasonUnknownSigner    DropReason = "unknown_signer"
+	DropReasonSignatureInvalid DropReason = "signature_invalid"
+)
+
+// KeyResolver looks up the key a ballot claims to be signed with. It stands
+// in for identity.UserKeychain.AuthorizedKeys(), which isn't implemented
+// yet; a caller backed by a real keychain store can satisfy this directly.
+type KeyResolver func(identityID uuid.UUID, signingKey identity.KeyID) (identity.AuthorizedKey, bool)
+
+// TerminalStatus reports the current status of an election, so Sweep can
+// tell a still-live election (whose committed ballots must keep blocking
+// replay) from one that's done (whose ballots can finally be forgotten).
+type TerminalStatus func(electionID string) (election.ElectionStatus, bool)
+
+const (
+	// defaultSeenCapacity bounds the LRU of not-yet-reaped ballot hashes -
+	// a capacity/DoS safety valve, not a correctness requirement, since a
+	// ballot that falls out of this cache before being reaped is simply
+	// re-verified on its next delivery rather than dropped incorrectly.
+	defaultSeenCapacity = 4096
+)
+
+// Ballot is the wire-level envelope a BallotMempool ingests: the signing
+// identity and cast tokens election.Ballot needs, plus which election/round
+// it's targeting so Reap can bucket it and a resubmission under a different
+// target can still be recognized as the same signed ballot.
+type Ballot struct {
+	ElectionID string
+	RoundID    string
+	IdentityID uuid.UUID
+	SigningKey identity.KeyID
+	DeclaredAt time.Time
+	Tokens     map[election.TokenTypeCode]float64
+	Signature  []byte
+}
+
+func (b Ballot) Identity() election.Identity                    { return ballotIdentity(b.IdentityID) }
+func (b Ballot) DeclaredTime() time.Time                        { return b.DeclaredAt }
+func (b Ballot) TokensCast() map[election.TokenTypeCode]float64 { return b.Tokens }
+
+type ballotIdentity uuid.UUID
+
+func (b ballotIdentity) ID() uuid.UUID { return uuid.UUID(b) }
+
+// canonicalBallot is the deterministic, field-ordered shape canonicalize
+// hashes. ElectionID/RoundID are deliberately excluded: they're the target
+// context a submitter attaches, not part of what the elector signed, so the
+// same signed ballot resubmitted under a different target is still
+// recognized as the same ballot for replay purposes.
+type canonicalBallot struct {
+	IdentityID string           `json:"identity_id"`
+	SigningKey string           `json:"signing_key"`
+	DeclaredAt int64            `json:"declared_at"`
+	Tokens     []canonicalToken `json:"tokens"`
+	Signature  []byte           `json:"signature,omitempty"`
+}
+
+type canonicalToken struct {
+	Type  election.TokenTypeCode `json:"type"`
+	Value float64                `json:"value"`
+}
+
+func (b Ballot) canonicalize(includeSignature bool) []byte {
+	tokens := make([]canonicalToken, 0, len(b.Tokens))
+	for t, v := range b.Tokens {
+		tokens = append(tokens, canonicalToken{Type: t, Value: v})
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Type < tokens[j].Type })
+
+	c := canonicalBallot{
+		IdentityID: b.IdentityID.String(),
+		SigningKey: uuid.UUID(b.SigningKey).String(),
+		DeclaredAt: b.DeclaredAt.UnixNano(),
+		Tokens:     tokens,
+	}
+	if includeSignature {
+		c.Signature = b.Signature
+	}
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		// canonicalBallot only holds marshalable primitives - this can't happen.
+		panic(fmt.Sprintf("mempool: canonicalizing ballot: %v", err))
+	}
+	return encoded
+}
+
+// Hash identifies this exact signed ballot for dedup/replay purposes.
+func (b Ballot) Hash() [32]byte {
+	return sha256.Sum256(b.canonicalize(true))
+}
+
+// signingPayload is what the elector's signature covers - everything but
+// the signature itself.
+func (b Ballot) signingPayload() []byte {
+	return b.canonicalize(false)
+}
+
+// ErrDropped is returned by Ingest when a ballot is refused. Reason lets a
+// caller (or the metrics it feeds) distinguish a hostile signature from
+// routine gossip dedup.
+type ErrDropped struct {
+	Reason DropReason
+}
+
+func (e ErrDropped) Error() string {
+	return fmt.Sprintf("mempool: ballot dropped: %s", e.Reason)
+}
+
+// Metrics is a point-in-time snapshot of mempool activity.
+type Metrics struct {
+	Pending      int
+	VerifyHits   int64 // Ingest calls short-circuited by a cache hit, skipping ed25519.Verify
+	VerifyMisses int64 // Ingest calls that missed the cache and went on to resolve the signer's key (and verify, if found)
+	Dropped      map[DropReason]int64
+}
+
+// VerifyHitRate is the fraction of Ingest calls that skipped signature
+// verification entirely because the ballot's hash was already known.
+func (m Metrics) VerifyHitRate() float64 {
+	total := m.VerifyHits + m.VerifyMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(m.VerifyHits) / float64(total)
+}
+
+// BallotMempool verifies incoming ballots once, deduplicates re-broadcasts
+// in O(1), and hands an election.Engine only the ballots cast for the round
+// it asks Reap for.
+type BallotMempool struct {
+	resolveKey KeyResolver
+	terminal   TerminalStatus
+	store      *db.PersistenceLayer
+	mempoolID  string
+
+	mu      sync.Mutex
+	pending map[string][]Ballot // "electionID/roundID" -> ballots awaiting Reap
+	seen    *hashCache          // bounded LRU: ingested, not yet reaped
+
+	// committed and committedByElection back replay protection for
+	// already-reaped ballots. Unlike seen, this can't be a plain capacity
+	// LRU: a committed hash must keep blocking replay for as long as its
+	// election is in progress, however long that takes, and must only be
+	// forgotten once Sweep observes the election has reached a terminal
+	// status. Unlike pending, losing these on restart is a real replay
+	// hole rather than just a resubmission nuisance, so they're the half
+	// of the mempool's state that gets persisted.
+	committed           map[[32]byte]string // hash -> electionID it was committed under
+	committedByElection map[string]map[[32]byte]struct{}
+
+	metrics Metrics
+}
+
+// NewBallotMempool builds a mempool, restoring its committed-ballot replay
+// protection from store under mempoolID if a prior snapshot exists. store
+// may be nil, in which case the mempool is purely in-memory (useful for
+// tests that don't care about restart recovery). resolveKey is consulted
+// on every Ingest that isn't a cache hit; terminal is consulted by Sweep.
+//
+// pending ballots are deliberately not persisted: losing them on restart
+// just means a submitter resubmits, which Ingest handles like any other
+// delivery. committed is persisted because losing it would let an
+// already-reaped ballot be replayed into a later round undetected.
+func NewBallotMempool(resolveKey KeyResolver, terminal TerminalStatus, store *db.PersistenceLayer, mempoolID string) (*BallotMempool, error) {
+	m := &BallotMempool{
+		resolveKey:          resolveKey,
+		terminal:            terminal,
+		store:               store,
+		mempoolID:           mempoolID,
+		pending:             map[string][]Ballot{},
+		seen:                newHashCache(defaultSeenCapacity),
+		committed:           map[[32]byte]string{},
+		committedByElection: map[string]map[[32]byte]struct{}{},
+		metrics:             Metrics{Dropped: map[DropReason]int64{}},
+	}
+	if store == nil {
+		return m, nil
+	}
+
+	data, _, err := store.FetchRaw(mempoolIdentifier{mempoolID: mempoolID}, "mempool_committed")
+	if err != nil {
+		return nil, fmt.Errorf("mempool: loading committed ballots %q: %w", mempoolID, err)
+	}
+	if len(data) == 0 {
+		return m, nil
+	}
+	var persisted []persistedCommitment
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return nil, fmt.Errorf("mempool: decoding persisted committed ballots %q: %w", mempoolID, err)
+	}
+	for _, p := range persisted {
+		hash, err := decodeHash(p.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("mempool: decoding persisted ballot hash %q: %w", p.Hash, err)
+		}
+		m.committed[hash] = p.ElectionID
+		if m.committedByElection[p.ElectionID] == nil {
+			m.committedByElection[p.ElectionID] = map[[32]byte]struct{}{}
+		}
+		m.committedByElection[p.ElectionID][hash] = struct{}{}
+	}
+	return m, nil
+}
+
+// persistedCommitment is the on-disk shape of one committed-ballot replay
+// record. committed's key is a [32]byte, which encoding/json can't use as
+// a map key, so committed is flattened to a slice the same way
+// finality.FinalityProof.Signatures is.
+type persistedCommitment struct {
+	Hash       string `json:"hash"`
+	ElectionID string `json:"election_id"`
+}
+
+func decodeHash(s string) ([32]byte, error) {
+	var hash [32]byte
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return hash, err
+	}
+	if len(decoded) != len(hash) {
+		return hash, fmt.Errorf("expected %d bytes, got %d", len(hash), len(decoded))
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+// persist snapshots committed to store, best-effort - matching
+// finality.Chain.persist, election.Engine.persistRound, and
+// model.TrustGraphImpl.persist, a failure here degrades restart recovery
+// rather than aborting an otherwise-healthy Reap or Sweep. Callers must
+// hold m.mu.
+func (m *BallotMempool) persist() {
+	if m.store == nil {
+		return
+	}
+	persisted := make([]persistedCommitment, 0, len(m.committed))
+	for hash, electionID := range m.committed {
+		persisted = append(persisted, persistedCommitment{
+			Hash:       hex.EncodeToString(hash[:]),
+			ElectionID: electionID,
+		})
+	}
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return
+	}
+	_ = m.store.WriteRaw(mempoolIdentifier{mempoolID: m.mempoolID}, "mempool_committed", data)
+}
+
+// mempoolIdentifier satisfies db.Identifier so BallotMempool can persist
+// through the shared PersistenceLayer under a "mempool_committed.<mempoolID>"
+// style key.
+type mempoolIdentifier struct {
+	mempoolID string
+}
+
+func (i mempoolIdentifier) Pairs() map[string]string {
+	return map[string]string{"mempool_id": i.mempoolID}
+}
+func (i mempoolIdentifier) Key() string  { return i.mempoolID }
+func (i mempoolIdentifier) Name() string { return "mempool_committed" }
+
+// Ingest verifies and admits a ballot. It's the single entry point both the
+// API's /ballot handler and a future gossip layer call, so every ballot -
+// whatever its source - goes through the same dedup/verification pipeline.
+func (m *BallotMempool) Ingest(b Ballot) error {
+	hash := b.Hash()
+
+	m.mu.Lock()
+	if _, ok := m.committed[hash]; ok {
+		m.recordDrop(DropReasonCommitted, true)
+		m.mu.Unlock()
+		return ErrDropped{Reason: DropReasonCommitted}
+	}
+	if m.seen.contains(hash) {
+		m.recordDrop(DropReasonDuplicate, true)
+		m.mu.Unlock()
+		return ErrDropped{Reason: DropReasonDuplicate}
+	}
+	m.mu.Unlock()
+
+	key, ok := m.resolveKey(b.IdentityID, b.SigningKey)
+	verified := ok && len(key.PublicKey) == ed25519.PublicKeySize &&
+		ed25519.Verify(ed25519.PublicKey(key.PublicKey), b.signingPayload(), b.Signature)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.metrics.VerifyMisses++
+
+	// A concurrent Ingest of the identical ballot could have won the race
+	// while this one was off resolving the key/verifying the signature.
+	if _, ok := m.committed[hash]; ok {
+		m.recordDrop(DropReasonCommitted, false)
+		return ErrDropped{Reason: DropReasonCommitted}
+	}
+	if m.seen.contains(hash) {
+		m.recordDrop(DropReasonDuplicate, false)
+		return ErrDropped{Reason: DropReasonDuplicate}
+	}
+
+	if !ok {
+		m.metrics.Dropped[DropReasonUnknownSigner]++
+		return ErrDropped{Reason: DropReasonUnknownSigner}
+	}
+	if !verified {
+		m.metrics.Dropped[DropReasonSignatureInvalid]++
+		return ErrDropped{Reason: DropReasonSignatureInvalid}
+	}
+
+	m.seen.add(hash)
+	roundKey := pendingKey(b.ElectionID, b.RoundID)
+	m.pending[roundKey] = append(m.pending[roundKey], b)
+	return nil
+}
+
+// recordDrop updates metrics for a drop found via cache lookup (cacheHit)
+// rather than full verification. Callers must hold mu.
+func (m *BallotMempool) recordDrop(reason DropReason, cacheHit bool) {
+	if cacheHit {
+		m.metrics.VerifyHits++
+	}
+	m.metrics.Dropped[reason]++
+}
+
+// Reap atomically removes and returns every pending ballot cast for
+// (electionID, roundID), committing their hashes so an identical ballot
+// resubmitted later - in this election's next round, or any other election
+// - is rejected by Ingest instead of silently re-admitted.
+func (m *BallotMempool) Reap(electionID, roundID string) []election.Ballot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := pendingKey(electionID, roundID)
+	ballots := m.pending[key]
+	delete(m.pending, key)
+
+	out := make([]election.Ballot, len(ballots))
+	for i, b := range ballots {
+		hash := b.Hash()
+		m.seen.remove(hash)
+		m.committed[hash] = electionID
+		if m.committedByElection[electionID] == nil {
+			m.committedByElection[electionID] = map[[32]byte]struct{}{}
+		}
+		m.committedByElection[electionID][hash] = struct{}{}
+		out[i] = b
+	}
+	m.persist()
+	return out
+}
+
+// Sweep forgets committed ballots belonging to any election terminal now
+// reports as no longer in progress, freeing their hashes. Callers - e.g.
+// whatever drives the election.Engine - should call this periodically or
+// right after observing an election conclude.
+func (m *BallotMempool) Sweep() {
+	if m.terminal == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	swept := false
+	for electionID, hashes := range m.committedByElection {
+		status, ok := m.terminal(electionID)
+		if !ok || status == election.ElectionStatusInProgress {
+			continue
+		}
+		for hash := range hashes {
+			delete(m.committed, hash)
+		}
+		delete(m.committedByElection, electionID)
+		swept = true
+	}
+	if swept {
+		m.persist()
+	}
+}
+
+// Metrics returns a point-in-time snapshot of mempool activity, suitable
+// for exposing on a /metrics endpoint.
+func (m *BallotMempool) Metrics() Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := 0
+	for _, ballots := range m.pending {
+		pending += len(ballots)
+	}
+	dropped := make(map[DropReason]int64, len(m.metrics.Dropped))
+	for reason, count := range m.metrics.Dropped {
+		dropped[reason] = count
+	}
+	return Metrics{
+		Pending:      pending,
+		VerifyHits:   m.metrics.VerifyHits,
+		VerifyMisses: m.metrics.VerifyMisses,
+		Dropped:      dropped,
+	}
+}
+
+func pendingKey(electionID, roundID string) string {
+	return electionID + "/" + roundID
+}
+
+// hashCache is a fixed-capacity LRU of ballot hashes, used to drop a
+// re-broadcast ballot in O(1) without re-verifying its signature.
+type hashCache struct {
+	capacity int
+	order    *list.List
+	index    map[[32]byte]*list.Element
+}
+
+func newHashCache(capacity int) *hashCache {
+	return &hashCache{capacity: capacity, order: list.New(), index: map[[32]byte]*list.Element{}}
+}
+
+func (c *hashCache) contains(hash [32]byte) bool {
+	_, ok := c.index[hash]
+	return ok
+}
+
+func (c *hashCache) remove(hash [32]byte) {
+	if el, ok := c.index[hash]; ok {
+		c.order.Remove(el)
+		delete(c.index, hash)
+	}
+}
+
+func (c *hashCache) add(hash [32]byte) {
+	if el, ok := c.index[hash]; ok {
+		c.order.MoveToFront(el)
+		return
+	}
+	el := c.order.PushFront(hash)
+	c.index[hash] = el
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.index, oldest.Value.([32]byte))
+		}
+	}
+}
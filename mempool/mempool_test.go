@@ -0,0 +1,240 @@
+package mempool
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/icook/tiny-congress/db"
+	"github.com/icook/tiny-congress/identity"
+	"github.com/icook/tiny-congress/storage/mem"
+	"github.com/icook/tiny-congress/v1/election"
+)
+
+func newTestMempool(t *testing.T, resolveKey KeyResolver, terminal TerminalStatus) *BallotMempool {
+	t.Helper()
+	mp, err := NewBallotMempool(resolveKey, terminal, nil, "test-mempool")
+	if err != nil {
+		t.Fatalf("NewBallotMempool: %v", err)
+	}
+	return mp
+}
+
+func newKeypair(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	return pub, priv
+}
+
+func signedBallot(t *testing.T, priv ed25519.PrivateKey, identityID uuid.UUID, signingKey identity.KeyID, electionID, roundID string) Ballot {
+	t.Helper()
+	b := Ballot{
+		ElectionID: electionID,
+		RoundID:    roundID,
+		IdentityID: identityID,
+		SigningKey: signingKey,
+		DeclaredAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Tokens:     map[election.TokenTypeCode]float64{"vote": 1},
+	}
+	b.Signature = ed25519.Sign(priv, b.signingPayload())
+	return b
+}
+
+// fixedResolver always resolves to the given key, regardless of who's asked
+// for - enough for these tests, which only exercise one signer at a time.
+func fixedResolver(key identity.AuthorizedKey) KeyResolver {
+	return func(uuid.UUID, identity.KeyID) (identity.AuthorizedKey, bool) {
+		return key, true
+	}
+}
+
+func TestIngestAcceptsValidlySignedBallot(t *testing.T) {
+	pub, priv := newKeypair(t)
+	identityID := uuid.New()
+	signingKey := identity.KeyID(uuid.New())
+	mp := newTestMempool(t, fixedResolver(identity.AuthorizedKey{PublicKey: pub}), nil)
+
+	b := signedBallot(t, priv, identityID, signingKey, "election-1", "round-1")
+	if err := mp.Ingest(b); err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+
+	metrics := mp.Metrics()
+	if metrics.Pending != 1 {
+		t.Fatalf("expected 1 pending ballot, got %d", metrics.Pending)
+	}
+	if metrics.VerifyMisses != 1 || metrics.VerifyHits != 0 {
+		t.Fatalf("expected one cold verification, got %+v", metrics)
+	}
+}
+
+func TestIngestRejectsInvalidSignature(t *testing.T) {
+	_, wrongPriv := newKeypair(t)
+	pub, priv := newKeypair(t)
+	identityID := uuid.New()
+	signingKey := identity.KeyID(uuid.New())
+	mp := newTestMempool(t, fixedResolver(identity.AuthorizedKey{PublicKey: pub}), nil)
+
+	b := signedBallot(t, wrongPriv, identityID, signingKey, "election-1", "round-1")
+	err := mp.Ingest(b)
+	dropped, ok := err.(ErrDropped)
+	if !ok || dropped.Reason != DropReasonSignatureInvalid {
+		t.Fatalf("expected a signature_invalid drop, got %v", err)
+	}
+
+	if metrics := mp.Metrics(); metrics.Pending != 0 {
+		t.Fatalf("expected the unverifiable ballot not to be admitted, got %d pending", metrics.Pending)
+	}
+
+	// Signature-failure eviction: the rejected ballot leaves no trace in the
+	// dedup cache, so a correctly-signed ballot with the same content (and
+	// thus a different hash, since the signature differs) is admitted
+	// normally rather than being shadowed by the earlier rejection.
+	corrected := signedBallot(t, priv, identityID, signingKey, "election-1", "round-1")
+	if err := mp.Ingest(corrected); err != nil {
+		t.Fatalf("expected the correctly-signed ballot to be admitted: %v", err)
+	}
+}
+
+func TestIngestDropsExactReplay(t *testing.T) {
+	pub, priv := newKeypair(t)
+	identityID := uuid.New()
+	signingKey := identity.KeyID(uuid.New())
+	mp := newTestMempool(t, fixedResolver(identity.AuthorizedKey{PublicKey: pub}), nil)
+
+	b := signedBallot(t, priv, identityID, signingKey, "election-1", "round-1")
+	if err := mp.Ingest(b); err != nil {
+		t.Fatalf("first Ingest: %v", err)
+	}
+
+	err := mp.Ingest(b)
+	dropped, ok := err.(ErrDropped)
+	if !ok || dropped.Reason != DropReasonDuplicate {
+		t.Fatalf("expected a duplicate drop on re-broadcast, got %v", err)
+	}
+
+	metrics := mp.Metrics()
+	if metrics.VerifyHits != 1 {
+		t.Fatalf("expected the replay to be caught by the dedup cache without re-verifying, got %+v", metrics)
+	}
+	if metrics.Pending != 1 {
+		t.Fatalf("expected the replay not to be admitted a second time, got %d pending", metrics.Pending)
+	}
+}
+
+func TestReapPreventsCrossRoundReplay(t *testing.T) {
+	pub, priv := newKeypair(t)
+	identityID := uuid.New()
+	signingKey := identity.KeyID(uuid.New())
+	statuses := map[string]election.ElectionStatus{"election-1": election.ElectionStatusInProgress}
+	mp := newTestMempool(t, fixedResolver(identity.AuthorizedKey{PublicKey: pub}), func(id string) (election.ElectionStatus, bool) {
+		status, ok := statuses[id]
+		return status, ok
+	})
+
+	b := signedBallot(t, priv, identityID, signingKey, "election-1", "round-1")
+	if err := mp.Ingest(b); err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+
+	reaped := mp.Reap("election-1", "round-1")
+	if len(reaped) != 1 {
+		t.Fatalf("expected 1 reaped ballot, got %d", len(reaped))
+	}
+
+	// The exact same signed ballot, resubmitted under a later round of the
+	// same election, must still be rejected as a replay.
+	replay := signedBallot(t, priv, identityID, signingKey, "election-1", "round-2")
+	replay.DeclaredAt = b.DeclaredAt // identical content -> identical hash
+	err := mp.Ingest(replay)
+	dropped, ok := err.(ErrDropped)
+	if !ok || dropped.Reason != DropReasonCommitted {
+		t.Fatalf("expected a committed drop on cross-round replay, got %v", err)
+	}
+
+	// Once the election reaches a terminal status and Sweep runs, the
+	// committed hash is forgotten.
+	statuses["election-1"] = election.ElectionStatusRatified
+	mp.Sweep()
+	if err := mp.Ingest(replay); err != nil {
+		t.Fatalf("expected replay to be admissible again after the election concluded and Sweep ran: %v", err)
+	}
+}
+
+func TestSweepLeavesInProgressElectionsCommitted(t *testing.T) {
+	pub, priv := newKeypair(t)
+	identityID := uuid.New()
+	signingKey := identity.KeyID(uuid.New())
+	mp := newTestMempool(t, fixedResolver(identity.AuthorizedKey{PublicKey: pub}), func(id string) (election.ElectionStatus, bool) {
+		return election.ElectionStatusInProgress, true
+	})
+
+	b := signedBallot(t, priv, identityID, signingKey, "election-1", "round-1")
+	if err := mp.Ingest(b); err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+	mp.Reap("election-1", "round-1")
+	mp.Sweep()
+
+	if err := mp.Ingest(b); err == nil {
+		t.Fatal("expected the replay to still be rejected while the election is in progress")
+	}
+}
+
+// TestNewBallotMempoolRestoresCommittedAfterRestart confirms a ballot
+// reaped (and thus committed) through one BallotMempool still blocks
+// replay through a second BallotMempool built against the same
+// store/mempoolID, simulating a restart.
+func TestNewBallotMempoolRestoresCommittedAfterRestart(t *testing.T) {
+	store, err := db.NewPersistenceLayer(mem.NewMemStore(), unregisteredTypeEngine{})
+	if err != nil {
+		t.Fatalf("NewPersistenceLayer: %v", err)
+	}
+	pub, priv := newKeypair(t)
+	identityID := uuid.New()
+	signingKey := identity.KeyID(uuid.New())
+
+	mp, err := NewBallotMempool(fixedResolver(identity.AuthorizedKey{PublicKey: pub}), func(id string) (election.ElectionStatus, bool) {
+		return election.ElectionStatusInProgress, true
+	}, store, "restart-mempool")
+	if err != nil {
+		t.Fatalf("NewBallotMempool: %v", err)
+	}
+
+	b := signedBallot(t, priv, identityID, signingKey, "election-1", "round-1")
+	if err := mp.Ingest(b); err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+	mp.Reap("election-1", "round-1")
+
+	restarted, err := NewBallotMempool(fixedResolver(identity.AuthorizedKey{PublicKey: pub}), func(id string) (election.ElectionStatus, bool) {
+		return election.ElectionStatusInProgress, true
+	}, store, "restart-mempool")
+	if err != nil {
+		t.Fatalf("NewBallotMempool after restart: %v", err)
+	}
+
+	replay := signedBallot(t, priv, identityID, signingKey, "election-1", "round-2")
+	replay.DeclaredAt = b.DeclaredAt // identical content -> identical hash
+	err = restarted.Ingest(replay)
+	dropped, ok := err.(ErrDropped)
+	if !ok || dropped.Reason != DropReasonCommitted {
+		t.Fatalf("expected the restored mempool to still reject the replay as committed, got %v", err)
+	}
+}
+
+// unregisteredTypeEngine models a realistic db.TypeEngine: one that has
+// never heard of "mempool_committed" and refuses to guess a ruleset for
+// it - BallotMempool's persistence must bypass it via WriteRaw rather
+// than UpdateKey, or this panics.
+type unregisteredTypeEngine struct{}
+
+func (unregisteredTypeEngine) GetRuleset(valueType string) db.TypeRuleset {
+	panic(fmt.Sprintf("no ruleset registered for valueType %q", valueType))
+}
@@ -0,0 +1,197 @@
+package wasm
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/icook/tiny-congress/db"
+	"github.com/icook/tiny-congress/v1/election"
+)
+
+// RoundRuleset dispatches election.RoundRuleset's IsRatified/IsRejected/
+// IsExtended calls through a wasm module when moduleURI names one
+// (wasm://<name>), and otherwise straight through to a native fallback
+// RoundRuleset.
+//
+// RulesetVersion is resolved once, in NewRoundRuleset, and pinned for the
+// lifetime of the value: a long-running election keeps dispatching to the
+// module revision it started with even if an operator hot-upgrades the
+// module mid-election.
+type RoundRuleset struct {
+	runtime   *Runtime
+	name      string
+	moduleURI string
+	fallback  election.RoundRuleset
+
+	RulesetVersion db.ResourceVersion
+}
+
+// NewRoundRuleset builds a RoundRuleset named name. If moduleURI is a
+// wasm:// URI, its current revision is resolved and pinned immediately;
+// otherwise every call passes straight through to fallback.
+func NewRoundRuleset(runtime *Runtime, name, moduleURI string, fallback election.RoundRuleset) (*RoundRuleset, error) {
+	rr := &RoundRuleset{runtime: runtime, name: name, moduleURI: moduleURI, fallback: fallback}
+	if IsModuleURI(moduleURI) {
+		version, err := runtime.CurrentVersion(ModuleName(moduleURI))
+		if err != nil {
+			return nil, errors.Wrapf(err, "wasm: resolving initial version for round ruleset %q", name)
+		}
+		rr.RulesetVersion = version
+		// Compile the pinned revision now so it is cached before any later
+		// write under the same name replaces its bytecode in the store.
+		if _, err := runtime.compiled(context.Background(), ModuleName(moduleURI), &version); err != nil {
+			return nil, errors.Wrapf(err, "wasm: compiling initial version for round ruleset %q", name)
+		}
+	}
+	return rr, nil
+}
+
+func (r *RoundRuleset) Name() string { return r.name }
+
+// RelevantTokenTypes is configuration, not a per-ballot verdict, so it's
+// always served from the fallback even for a wasm-backed ruleset - the
+// module itself only needs to judge ratify/reject/extend.
+func (r *RoundRuleset) RelevantTokenTypes() []string {
+	return r.fallback.RelevantTokenTypes()
+}
+
+// roundVerdict is the JSON shape a round ruleset module returns from handle.
+type roundVerdict struct {
+	Ratified bool             `json:"ratified"`
+	Rejected *retryOptionJSON `json:"rejected,omitempty"`
+	Extended *extensionJSON   `json:"extended,omitempty"`
+}
+
+type retryOptionJSON struct {
+	RetryAfterNanos int64 `json:"retry_after_nanos"`
+}
+
+type extensionJSON struct {
+	DurationNanos int64 `json:"duration_nanos"`
+}
+
+type ballotJSON struct {
+	IdentityID   string                             `json:"identity_id"`
+	DeclaredTime time.Time                          `json:"declared_time"`
+	TokensCast   map[election.TokenTypeCode]float64 `json:"tokens_cast"`
+}
+
+func ballotsToJSON(ballots []election.Ballot) []ballotJSON {
+	out := make([]ballotJSON, len(ballots))
+	for i, b := range ballots {
+		out[i] = ballotJSON{
+			IdentityID:   b.Identity().ID().String(),
+			DeclaredTime: b.DeclaredTime(),
+			TokensCast:   b.TokensCast(),
+		}
+	}
+	return out
+}
+
+// dispatch calls the pinned module revision with ballots JSON-encoded, and
+// reports whether a wasm module handled this call at all (false means the
+// ruleset isn't wasm-backed and the caller should use its fallback).
+func (r *RoundRuleset) dispatch(ballots []election.Ballot) (roundVerdict, bool, error) {
+	if !IsModuleURI(r.moduleURI) {
+		return roundVerdict{}, false, nil
+	}
+	input, err := json.Marshal(ballotsToJSON(ballots))
+	if err != nil {
+		return roundVerdict{}, true, errors.Wrap(err, "wasm: marshaling ballots")
+	}
+	output, err := r.runtime.CallVersion(context.Background(), ModuleName(r.moduleURI), r.RulesetVersion, input)
+	if err != nil {
+		return roundVerdict{}, true, errors.Wrapf(err, "wasm: dispatching round ruleset %q", r.name)
+	}
+	var v roundVerdict
+	if err := json.Unmarshal(output, &v); err != nil {
+		return roundVerdict{}, true, errors.Wrap(err, "wasm: decoding round ruleset verdict")
+	}
+	return v, true, nil
+}
+
+func (r *RoundRuleset) IsRatified(ballots []election.Ballot) bool {
+	v, handled, err := r.dispatch(ballots)
+	if !handled {
+		return r.fallback.IsRatified(ballots)
+	}
+	if err != nil {
+		// A misbehaving or failed wasm module shouldn't be able to force a
+		// ratification - fail closed.
+		return false
+	}
+	return v.Ratified
+}
+
+func (r *RoundRuleset) IsRejected(ballots []election.Ballot) election.RetryOption {
+	v, handled, err := r.dispatch(ballots)
+	if !handled {
+		return r.fallback.IsRejected(ballots)
+	}
+	if err != nil || v.Rejected == nil {
+		return nil
+	}
+	return election.FixedRetryOption(time.Duration(v.Rejected.RetryAfterNanos))
+}
+
+func (r *RoundRuleset) IsExtended(ballots []election.Ballot) election.RoundExtension {
+	v, handled, err := r.dispatch(ballots)
+	if !handled {
+		return r.fallback.IsExtended(ballots)
+	}
+	if err != nil || v.Extended == nil {
+		return nil
+	}
+	return election.FixedRoundExtension(time.Duration(v.Extended.DurationNanos))
+}
+
+// TypeRuleset dispatches db.TypeRuleset.MaySet through a wasm module when
+// moduleURI names one, falling back to native otherwise - the
+// object-ruleset analogue of RoundRuleset above. Unlike RoundRuleset, there
+// is no version pinning: object validation always runs against whatever
+// ruleset is currently published.
+type TypeRuleset struct {
+	runtime   *Runtime
+	moduleURI string
+	fallback  db.TypeRuleset
+}
+
+// NewTypeRuleset builds a db.TypeRuleset that dispatches through runtime
+// when moduleURI is a wasm:// URI, and otherwise straight through to
+// fallback.
+func NewTypeRuleset(runtime *Runtime, moduleURI string, fallback db.TypeRuleset) db.TypeRuleset {
+	return &TypeRuleset{runtime: runtime, moduleURI: moduleURI, fallback: fallback}
+}
+
+type maySetVerdict struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+func (t *TypeRuleset) MaySet(newValue string) error {
+	if !IsModuleURI(t.moduleURI) {
+		return t.fallback.MaySet(newValue)
+	}
+
+	input, err := json.Marshal(struct {
+		Value string `json:"value"`
+	}{Value: newValue})
+	if err != nil {
+		return errors.Wrap(err, "wasm: marshaling MaySet input")
+	}
+	output, err := t.runtime.Call(context.Background(), ModuleName(t.moduleURI), input)
+	if err != nil {
+		return errors.Wrap(err, "wasm: dispatching object ruleset MaySet")
+	}
+	var verdict maySetVerdict
+	if err := json.Unmarshal(output, &verdict); err != nil {
+		return errors.Wrap(err, "wasm: decoding MaySet verdict")
+	}
+	if !verdict.Allowed {
+		return errors.Errorf("wasm: value rejected by object ruleset: %s", verdict.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// Package wasm is the pluggable runtime both election.RoundRuleset and
+// db.TypeRuleset implementations dispatch into when a "wasm://<module>" URI
+// is configured instead of a native Go implementation. It loads module
+// bytecode by name from a db.PersistenceLayer, compiles it with wazero (pure
+// Go, no cgo), and exposes a small host ABI so guest code can read a
+// JSON-encoded input, optionally look up extra KV data, and write back a
+// JSON-encoded verdict.
+package wasm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+
+	"github.com/icook/tiny-congress/db"
+)
+
+// modulePrefix marks a ruleset/type configuration value as backed by a wasm
+// module loaded from the database, e.g. "wasm://round_ruleset.simple_majority".
+const modulePrefix = "wasm://"
+
+// IsModuleURI reports whether uri names a wasm-backed module rather than a
+// native Go implementation.
+func IsModuleURI(uri string) bool {
+	return strings.HasPrefix(uri, modulePrefix)
+}
+
+// ModuleName extracts the database key a wasm:// URI names.
+func ModuleName(uri string) string {
+	return strings.TrimPrefix(uri, modulePrefix)
+}
+
+// KVLookup resolves additional keys a guest module asks for via the get_kv
+// host function - e.g. network configuration parameters that live alongside
+// the module bytecode in the database.
+type KVLookup func(key string) ([]byte, bool)
+
+// maxKVValueSize bounds how much of a KVLookup result get_kv will copy into
+// the guest's scratch buffer; callers needing more should chunk their own
+// reads via repeated get_kv calls with an offset-aware key scheme.
+const maxKVValueSize = 4096
+
+type cachedModule struct {
+	revision db.ResourceVersion
+	compiled wazero.CompiledModule
+}
+
+// moduleIdentifier satisfies db.Identifier for module bytecode lookups.
+type moduleIdentifier struct{ name string }
+
+func (m moduleIdentifier) Pairs() map[string]string { return map[string]string{"module": m.name} }
+func (m moduleIdentifier) Key() string              { return m.name }
+func (m moduleIdentifier) Name() string             { return "module" }
+
+// Runtime loads wasm bytecode for named modules out of a db.PersistenceLayer,
+// compiles and caches it, and runs guest code against the host ABI below.
+//
+// Cache entries are keyed by (name, revision), so a hot upgrade - a new
+// write under the same name, bumping its ResourceVersion - is picked up by
+// any caller asking for the current revision, while a caller pinned to an
+// older revision (see CallVersion) keeps hitting its own cache entry for as
+// long as that entry stays around.
+type Runtime struct {
+	store     *db.PersistenceLayer
+	valueType string
+	kv        KVLookup
+	logger    func(string)
+
+	rt wazero.Runtime
+
+	callMu sync.Mutex
+	state  *callState
+
+	mu    sync.Mutex
+	cache map[string]*cachedModule
+}
+
+// NewRuntime builds a Runtime that loads module bytecode from store under
+// valueType (e.g. "round_ruleset" or "object_ruleset"), resolving get_kv
+// lookups through kv if provided (a nil kv makes get_kv always report "not
+// found").
+func NewRuntime(ctx context.Context, store *db.PersistenceLayer, valueType string, kv KVLookup) (*Runtime, error) {
+	r := &Runtime{
+		store:     store,
+		valueType: valueType,
+		kv:        kv,
+		logger:    func(string) {},
+		rt:        wazero.NewRuntime(ctx),
+		cache:     map[string]*cachedModule{},
+	}
+	if err := r.registerHostModule(ctx); err != nil {
+		return nil, errors.Wrap(err, "wasm: registering host module")
+	}
+	return r, nil
+}
+
+// SetLogger overrides what the log host function does with a guest's
+// messages; the default discards them.
+func (r *Runtime) SetLogger(logger func(string)) {
+	r.logger = logger
+}
+
+// CurrentVersion reports the revision name is currently stored at, for a
+// caller (e.g. an in-flight election) to pin via CallVersion.
+func (r *Runtime) CurrentVersion(name string) (db.ResourceVersion, error) {
+	_, rev, err := r.store.FetchRaw(moduleIdentifier{name: name}, r.valueType)
+	if err != nil {
+		return 0, errors.Wrapf(err, "wasm: resolving current version of module %q", name)
+	}
+	return rev, nil
+}
+
+// Call loads (or reuses a cached compile of) the current revision of the
+// module named name, invokes its "handle" export, and returns whatever it
+// passes to write_output.
+func (r *Runtime) Call(ctx context.Context, name string, input []byte) ([]byte, error) {
+	return r.call(ctx, name, nil, input)
+}
+
+// CallVersion is Call pinned to a specific module revision (captured via
+// CurrentVersion when the caller first started using the module), so a hot
+// upgrade written mid-use doesn't change behavior out from under it. It can
+// only serve a revision still present in the cache - there's no historical
+// bytecode to fall back to once a module has been overwritten and evicted.
+func (r *Runtime) CallVersion(ctx context.Context, name string, version db.ResourceVersion, input []byte) ([]byte, error) {
+	return r.call(ctx, name, &version, input)
+}
+
+func (r *Runtime) call(ctx context.Context, name string, pinned *db.ResourceVersion, input []byte) ([]byte, error) {
+	compiled, err := r.compiled(ctx, name, pinned)
+	if err != nil {
+		return nil, err
+	}
+	return r.invoke(ctx, compiled, input)
+}
+
+func (r *Runtime) compiled(ctx context.Context, name string, pinned *db.ResourceVersion) (wazero.CompiledModule, error) {
+	data, currentRev, err := r.store.FetchRaw(moduleIdentifier{name: name}, r.valueType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "wasm: loading module %q", name)
+	}
+
+	targetRev := currentRev
+	if pinned != nil {
+		targetRev = *pinned
+	}
+	cacheKey := fmt.Sprintf("%s@%d", name, targetRev)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.cache[cacheKey]; ok {
+		return entry.compiled, nil
+	}
+	if pinned != nil && *pinned != currentRev {
+		return nil, errors.Errorf("wasm: module %q revision %d is no longer available (current revision is %d)", name, *pinned, currentRev)
+	}
+
+	compiled, err := r.rt.CompileModule(ctx, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "wasm: compiling module %q", name)
+	}
+	r.cache[cacheKey] = &cachedModule{revision: targetRev, compiled: compiled}
+	return compiled, nil
+}
+
+// callState is the per-Call scratch state the host functions below read
+// from and write into; invoke serializes calls through callMu so only one
+// call is ever in flight against it at a time.
+type callState struct {
+	input  []byte
+	output []byte
+	kv     KVLookup
+	logger func(string)
+}
+
+func (r *Runtime) invoke(ctx context.Context, compiled wazero.CompiledModule, input []byte) ([]byte, error) {
+	r.callMu.Lock()
+	defer r.callMu.Unlock()
+
+	r.state = &callState{input: input, kv: r.kv, logger: r.logger}
+	defer func() { r.state = nil }()
+
+	instance, err := r.rt.InstantiateModule(ctx, compiled, wazero.NewModuleConfig())
+	if err != nil {
+		return nil, errors.Wrap(err, "wasm: instantiating guest module")
+	}
+	defer instance.Close(ctx)
+
+	handle := instance.ExportedFunction("handle")
+	if handle == nil {
+		return nil, errors.New(`wasm: guest module does not export "handle"`)
+	}
+	if _, err := handle.Call(ctx); err != nil {
+		return nil, errors.Wrap(err, "wasm: calling guest handle")
+	}
+	return r.state.output, nil
+}
+
+// registerHostModule exports the stable guest-facing ABI - read_input,
+// write_output, log, get_kv - into the "env" namespace every compiled
+// module is instantiated against.
+func (r *Runtime) registerHostModule(ctx context.Context) error {
+	_, err := r.rt.NewHostModuleBuilder("env").
+		NewFunctionBuilder().WithFunc(r.hostReadInput).Export("read_input").
+		NewFunctionBuilder().WithFunc(r.hostWriteOutput).Export("write_output").
+		NewFunctionBuilder().WithFunc(r.hostLog).Export("log").
+		NewFunctionBuilder().WithFunc(r.hostGetKV).Export("get_kv").
+		Instantiate(ctx)
+	return err
+}
+
+// hostReadInput copies up to maxLen bytes of the current call's input
+// into guest memory at ptr, returning how many bytes were actually copied.
+func (r *Runtime) hostReadInput(ctx context.Context, mod api.Module, ptr, maxLen uint32) uint32 {
+	input := r.state.input
+	n := uint32(len(input))
+	if n > maxLen {
+		n = maxLen
+	}
+	if n > 0 {
+		mod.Memory().Write(ptr, input[:n])
+	}
+	return n
+}
+
+// hostWriteOutput records len bytes of guest memory starting at ptr as this
+// call's result.
+func (r *Runtime) hostWriteOutput(ctx context.Context, mod api.Module, ptr, length uint32) {
+	data, ok := mod.Memory().Read(ptr, length)
+	if !ok {
+		return
+	}
+	out := make([]byte, length)
+	copy(out, data)
+	r.state.output = out
+}
+
+// hostLog hands len bytes of guest memory starting at ptr, interpreted as a
+// UTF-8 message, to the configured logger.
+func (r *Runtime) hostLog(ctx context.Context, mod api.Module, ptr, length uint32) {
+	data, ok := mod.Memory().Read(ptr, length)
+	if !ok {
+		return
+	}
+	r.state.logger(string(data))
+}
+
+// hostGetKV looks up the key named by len bytes of guest memory at keyPtr,
+// writes up to maxKVValueSize bytes of the result at outPtr, and returns the
+// number of bytes written, or -1 if the key isn't found.
+func (r *Runtime) hostGetKV(ctx context.Context, mod api.Module, keyPtr, keyLen, outPtr uint32) int32 {
+	if r.state.kv == nil {
+		return -1
+	}
+	keyBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+	if !ok {
+		return -1
+	}
+	value, found := r.state.kv(string(keyBytes))
+	if !found {
+		return -1
+	}
+	if len(value) > maxKVValueSize {
+		value = value[:maxKVValueSize]
+	}
+	if len(value) > 0 && !mod.Memory().Write(outPtr, value) {
+		return -1
+	}
+	return int32(len(value))
+}
@@ -0,0 +1,234 @@
+package wasm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/icook/tiny-congress/db"
+	"github.com/icook/tiny-congress/storage/mem"
+)
+
+type passthroughRuleset struct{}
+
+func (passthroughRuleset) MaySet(string) error { return nil }
+
+type passthroughEngine struct{}
+
+func (passthroughEngine) GetRuleset(string) db.TypeRuleset { return passthroughRuleset{} }
+
+type moduleIdent struct{ name string }
+
+func (m moduleIdent) Pairs() map[string]string { return map[string]string{"module": m.name} }
+func (m moduleIdent) Key() string              { return m.name }
+func (m moduleIdent) Name() string             { return "module" }
+
+func newTestStore(t *testing.T) *db.PersistenceLayer {
+	t.Helper()
+	store, err := db.NewPersistenceLayer(mem.NewMemStore(), passthroughEngine{})
+	if err != nil {
+		t.Fatalf("NewPersistenceLayer: %v", err)
+	}
+	return store
+}
+
+func putModule(t *testing.T, store *db.PersistenceLayer, valueType, name string, bytecode []byte) {
+	t.Helper()
+	if err := store.UpdateKey(moduleIdent{name: name}, "", string(bytecode), valueType); err != nil {
+		t.Fatalf("UpdateKey: %v", err)
+	}
+}
+
+func TestRuntimeEchoesInputThroughHostABI(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	putModule(t, store, "round_ruleset", "echo", echoModule())
+
+	rt, err := NewRuntime(ctx, store, "round_ruleset", nil)
+	if err != nil {
+		t.Fatalf("NewRuntime: %v", err)
+	}
+
+	out, err := rt.Call(ctx, "echo", []byte("hello wasm"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if string(out) != "hello wasm" {
+		t.Fatalf("expected echo of input, got %q", out)
+	}
+}
+
+func TestRuntimeHotUpgradeInvalidatesCache(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	putModule(t, store, "round_ruleset", "echo", echoModule())
+
+	rt, err := NewRuntime(ctx, store, "round_ruleset", nil)
+	if err != nil {
+		t.Fatalf("NewRuntime: %v", err)
+	}
+
+	firstVersion, err := rt.CurrentVersion("echo")
+	if err != nil {
+		t.Fatalf("CurrentVersion: %v", err)
+	}
+
+	if _, err := rt.Call(ctx, "echo", []byte("v1")); err != nil {
+		t.Fatalf("Call (v1): %v", err)
+	}
+
+	// Publish the "same" module again under the same name - this is the
+	// hot-upgrade path: WriteKey bumps the mem driver's revision counter.
+	putModule(t, store, "round_ruleset", "echo", echoModule())
+
+	secondVersion, err := rt.CurrentVersion("echo")
+	if err != nil {
+		t.Fatalf("CurrentVersion: %v", err)
+	}
+	if secondVersion == firstVersion {
+		t.Fatalf("expected revision to bump after republishing the module, stayed at %d", firstVersion)
+	}
+
+	// Calls asking for the current revision pick up the new compile...
+	if out, err := rt.Call(ctx, "echo", []byte("v2")); err != nil || string(out) != "v2" {
+		t.Fatalf("Call after upgrade: out=%q err=%v", out, err)
+	}
+
+	// ...while a caller still pinned to the original revision keeps using
+	// the cache entry it started with.
+	if out, err := rt.CallVersion(ctx, "echo", firstVersion, []byte("pinned")); err != nil || string(out) != "pinned" {
+		t.Fatalf("CallVersion pinned to stale revision: out=%q err=%v", out, err)
+	}
+}
+
+func TestRuntimeCallVersionRejectsUnknownRevision(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	putModule(t, store, "round_ruleset", "echo", echoModule())
+
+	rt, err := NewRuntime(ctx, store, "round_ruleset", nil)
+	if err != nil {
+		t.Fatalf("NewRuntime: %v", err)
+	}
+
+	if _, err := rt.CallVersion(ctx, "echo", db.ResourceVersion(9999), []byte("x")); err == nil {
+		t.Fatal("expected an error pinning to a revision never seen by this Runtime")
+	}
+}
+
+// echoModule hand-assembles a minimal wasm binary (no WAT toolchain is
+// available to generate one) that imports env.read_input/write_output,
+// exports "handle" and "memory", and simply copies its input back out as
+// its output - enough to exercise the host<->guest ABI end to end without a
+// real ruleset module.
+func echoModule() []byte {
+	i32 := byte(0x7f)
+
+	funcType := func(params, results []byte) []byte {
+		out := []byte{0x60}
+		out = append(out, uleb128(uint32(len(params)))...)
+		out = append(out, params...)
+		out = append(out, uleb128(uint32(len(results)))...)
+		out = append(out, results...)
+		return out
+	}
+
+	typeSec := uleb128(3)
+	typeSec = append(typeSec, funcType([]byte{i32, i32}, []byte{i32})...) // 0: read_input
+	typeSec = append(typeSec, funcType([]byte{i32, i32}, nil)...)         // 1: write_output
+	typeSec = append(typeSec, funcType(nil, nil)...)                      // 2: handle
+
+	importSec := uleb128(2)
+	importSec = append(importSec, wasmName("env")...)
+	importSec = append(importSec, wasmName("read_input")...)
+	importSec = append(importSec, 0x00)
+	importSec = append(importSec, uleb128(0)...)
+	importSec = append(importSec, wasmName("env")...)
+	importSec = append(importSec, wasmName("write_output")...)
+	importSec = append(importSec, 0x00)
+	importSec = append(importSec, uleb128(1)...)
+
+	funcSec := append(uleb128(1), uleb128(2)...)
+
+	memSec := append(uleb128(1), byte(0x00))
+	memSec = append(memSec, uleb128(1)...)
+
+	exportSec := uleb128(2)
+	exportSec = append(exportSec, wasmName("handle")...)
+	exportSec = append(exportSec, 0x00)
+	exportSec = append(exportSec, uleb128(2)...) // func index 2 (after 2 imports)
+	exportSec = append(exportSec, wasmName("memory")...)
+	exportSec = append(exportSec, 0x02)
+	exportSec = append(exportSec, uleb128(0)...)
+
+	// (local $n i32)
+	// i32.const 0; i32.const 4096; call $read_input; local.set $n
+	// i32.const 0; local.get $n; call $write_output
+	localDecl := append(uleb128(1), uleb128(1)...)
+	localDecl = append(localDecl, i32)
+	instrs := []byte{0x41}
+	instrs = append(instrs, sleb128(0)...)
+	instrs = append(instrs, 0x41)
+	instrs = append(instrs, sleb128(4096)...)
+	instrs = append(instrs, 0x10, 0x00)
+	instrs = append(instrs, 0x21, 0x00)
+	instrs = append(instrs, 0x41)
+	instrs = append(instrs, sleb128(0)...)
+	instrs = append(instrs, 0x20, 0x00)
+	instrs = append(instrs, 0x10, 0x01)
+	instrs = append(instrs, 0x0B)
+	body := append(localDecl, instrs...)
+	codeSec := uleb128(1)
+	codeSec = append(codeSec, uleb128(uint32(len(body)))...)
+	codeSec = append(codeSec, body...)
+
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, wasmSection(1, typeSec)...)
+	module = append(module, wasmSection(2, importSec)...)
+	module = append(module, wasmSection(3, funcSec)...)
+	module = append(module, wasmSection(5, memSec)...)
+	module = append(module, wasmSection(7, exportSec)...)
+	module = append(module, wasmSection(10, codeSec)...)
+	return module
+}
+
+func wasmSection(id byte, content []byte) []byte {
+	out := []byte{id}
+	out = append(out, uleb128(uint32(len(content)))...)
+	return append(out, content...)
+}
+
+func wasmName(s string) []byte {
+	return append(uleb128(uint32(len(s))), []byte(s)...)
+}
+
+func uleb128(v uint32) []byte {
+	var buf []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if v == 0 {
+			break
+		}
+	}
+	return buf
+}
+
+func sleb128(v int64) []byte {
+	var buf []byte
+	more := true
+	for more {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			more = false
+		} else {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
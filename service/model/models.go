@@ -1,9 +1,15 @@
-package tinycongress
+package model
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"sync"
 	"time"
+
+	"github.com/icook/tiny-congress/db"
 )
 
 // Attestation represents a trust attestation between entities
@@ -19,13 +25,39 @@ type Attestation struct {
 // TrustGraphImpl implements the TrustGraph interface
 type TrustGraphImpl struct {
 	attestations []Attestation
+	store        *db.PersistenceLayer
+	graphID      string
 	mu           sync.RWMutex
 }
 
-func NewTrustGraph() *TrustGraphImpl {
-	return &TrustGraphImpl{
+// NewTrustGraph builds a TrustGraphImpl, restoring its attestations from
+// store under graphID if a prior snapshot exists. store may be nil, in
+// which case the graph is purely in-memory and AddAttestation simply
+// doesn't persist (useful for tests that don't care about restart
+// recovery).
+func NewTrustGraph(store *db.PersistenceLayer, graphID string) (*TrustGraphImpl, error) {
+	g := &TrustGraphImpl{
 		attestations: make([]Attestation, 0),
+		store:        store,
+		graphID:      graphID,
+	}
+	if store == nil {
+		return g, nil
+	}
+
+	data, _, err := store.FetchRaw(trustGraphIdentifier{graphID: graphID}, "trust_graph")
+	if err != nil {
+		return nil, fmt.Errorf("model: loading trust graph %q: %w", graphID, err)
 	}
+	if len(data) == 0 {
+		return g, nil
+	}
+	var attestations []Attestation
+	if err := json.Unmarshal(data, &attestations); err != nil {
+		return nil, fmt.Errorf("model: decoding persisted trust graph %q: %w", graphID, err)
+	}
+	g.attestations = attestations
+	return g, nil
 }
 
 func (g *TrustGraphImpl) AddAttestation(attestorID, subjectID, dimension string, value float64, signature []byte) error {
@@ -45,9 +77,40 @@ func (g *TrustGraphImpl) AddAttestation(attestorID, subjectID, dimension string,
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	g.attestations = append(g.attestations, attestation)
+	g.persist()
 	return nil
 }
 
+// persist snapshots the graph's attestations to store, best-effort -
+// matching finality.Chain.persist and election.Engine.persistRound, a
+// failure here degrades restart recovery rather than aborting an
+// otherwise-healthy AddAttestation. It writes through WriteRaw rather than
+// UpdateKey since this snapshot is our own internal bookkeeping, not a
+// type-governed value. Callers must hold g.mu.
+func (g *TrustGraphImpl) persist() {
+	if g.store == nil {
+		return
+	}
+	data, err := json.Marshal(g.attestations)
+	if err != nil {
+		return
+	}
+	_ = g.store.WriteRaw(trustGraphIdentifier{graphID: g.graphID}, "trust_graph", data)
+}
+
+// trustGraphIdentifier satisfies db.Identifier so TrustGraphImpl can persist
+// through the shared PersistenceLayer under a "trust_graph.<graphID>" style
+// key.
+type trustGraphIdentifier struct {
+	graphID string
+}
+
+func (i trustGraphIdentifier) Pairs() map[string]string {
+	return map[string]string{"graph_id": i.graphID}
+}
+func (i trustGraphIdentifier) Key() string  { return i.graphID }
+func (i trustGraphIdentifier) Name() string { return "trust_graph" }
+
 func (g *TrustGraphImpl) VerifyAttestation(attestation Attestation) (bool, error) {
 	// In a real implementation, this would verify the cryptographic signature
 	// For now, we'll do basic validation
@@ -57,32 +120,223 @@ func (g *TrustGraphImpl) VerifyAttestation(attestation Attestation) (bool, error
 	return true, nil
 }
 
-func (g *TrustGraphImpl) ConvergeTrustGraph() (map[string]map[string]float64, error) {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
+// Convergence tuning constants for ConvergeTrustGraph's repeated-sampling
+// algorithm - a Snowball-style scheme (as used by Avalanche consensus) rather
+// than a flat average, so a Sybil can't just outnumber genuine attestors.
+const (
+	// convergeMaxRounds bounds how many sampling rounds run per dimension
+	// before giving up on any node that hasn't reached convergence.
+	convergeMaxRounds = 150
+	// convergeSampleSize is how many attestors are sampled (with
+	// replacement) per subject, per round, when a subject has more than
+	// that many; a smaller pool is used in full (see sampleWeightedMean).
+	convergeSampleSize = 20
+	// convergeAlpha is how much weight each round's sampled mean carries
+	// against a node's prior score.
+	convergeAlpha = 0.3
+	// convergeEpsilon is the delta below which a round counts toward a
+	// node's confidence streak instead of resetting it.
+	convergeEpsilon = 1e-4
+	// convergeBeta is the confidence streak length at which a node is
+	// considered converged and frozen for the rest of the run.
+	convergeBeta = 15
+	// convergeDecayLambda controls how fast an attestation's weight decays
+	// with age (in hours) via exp(-lambda*age).
+	convergeDecayLambda = 0.01
+	// neutralTrustScore seeds a node with no better prior.
+	neutralTrustScore = 0.5
+)
 
-	// Simple averaging of attestations per dimension
-	results := make(map[string]map[string]float64)
-	counts := make(map[string]map[string]int)
+// TrustScoreSeed resolves a node's starting score for a dimension before
+// convergence begins - e.g. from UserImpl.TrustScores - reporting ok=false
+// to leave the node at neutralTrustScore.
+type TrustScoreSeed func(nodeID, dimension string) (value float64, ok bool)
 
+// TrustScoreSeedFromUsers adapts a set of UserImpls, keyed by the node ID
+// attestations reference them by, into a TrustScoreSeed: a node's starting
+// score for a dimension is the mean of whatever sub-dimension scores that
+// user has already recorded for it, so convergence starts from a user's own
+// prior self-assessment instead of discarding it.
+func TrustScoreSeedFromUsers(users map[string]*UserImpl) TrustScoreSeed {
+	return func(nodeID, dimension string) (float64, bool) {
+		user, ok := users[nodeID]
+		if !ok {
+			return 0, false
+		}
+		scores, err := user.GetTrustScores()
+		if err != nil {
+			return 0, false
+		}
+		subScores, ok := scores[dimension]
+		if !ok || len(subScores) == 0 {
+			return 0, false
+		}
+		var sum float64
+		for _, v := range subScores {
+			sum += v
+		}
+		return sum / float64(len(subScores)), true
+	}
+}
+
+// ConvergenceResult is what ConvergeTrustGraph returns: the converged score
+// per (subject, dimension), whether each one actually reached convergence
+// before convergeMaxRounds ran out, and the number of rounds the slowest
+// dimension needed.
+type ConvergenceResult struct {
+	Scores    map[string]map[string]float64
+	Converged map[string]map[string]bool
+	Rounds    int
+}
+
+// nodeState is one node's (attestor or subject - the same ID can be both)
+// running score and confidence streak within a single dimension's
+// convergence run.
+type nodeState struct {
+	score      float64
+	confidence int
+	converged  bool
+}
+
+// ConvergeTrustGraph replaces naive per-(subject,dimension) averaging with a
+// Snowball-style repeated-sampling scheme: each round, every subject's score
+// is pulled toward the trust-weighted mean of a random sample of its
+// attestors, where the weight is the attestor's own current score in that
+// dimension. A node freezes once its score stops moving for convergeBeta
+// consecutive rounds. seed may be nil.
+func (g *TrustGraphImpl) ConvergeTrustGraph(seed TrustScoreSeed) (ConvergenceResult, error) {
+	g.mu.RLock()
+	byDimension := make(map[string][]Attestation)
 	for _, att := range g.attestations {
-		if results[att.SubjectID] == nil {
-			results[att.SubjectID] = make(map[string]float64)
-			counts[att.SubjectID] = make(map[string]int)
+		byDimension[att.Dimension] = append(byDimension[att.Dimension], att)
+	}
+	g.mu.RUnlock()
+
+	result := ConvergenceResult{
+		Scores:    make(map[string]map[string]float64),
+		Converged: make(map[string]map[string]bool),
+	}
+
+	for dimension, attestations := range byDimension {
+		subjects, nodes, rounds := convergeDimension(attestations, dimension, seed)
+		if rounds > result.Rounds {
+			result.Rounds = rounds
+		}
+		for _, subjectID := range subjects {
+			if result.Scores[subjectID] == nil {
+				result.Scores[subjectID] = make(map[string]float64)
+				result.Converged[subjectID] = make(map[string]bool)
+			}
+			node := nodes[subjectID]
+			result.Scores[subjectID][dimension] = node.score
+			result.Converged[subjectID][dimension] = node.converged
 		}
-		results[att.SubjectID][att.Dimension] += att.Value
-		counts[att.SubjectID][att.Dimension]++
 	}
 
-	// Calculate averages
-	for subjectID, dimensions := range results {
-		for dimension, total := range dimensions {
-			count := counts[subjectID][dimension]
-			if count > 0 {
-				results[subjectID][dimension] = total / float64(count)
+	return result, nil
+}
+
+// convergeDimension runs the sampling rounds for a single dimension's
+// attestations, returning the subjects attested to in it, every node's final
+// state (subjects and attestors share the same score space, since an
+// attestor in one attestation may be the subject of another), and how many
+// rounds actually ran.
+func convergeDimension(attestations []Attestation, dimension string, seed TrustScoreSeed) ([]string, map[string]*nodeState, int) {
+	adjacency := make(map[string][]Attestation)
+	nodes := make(map[string]*nodeState)
+
+	ensureNode := func(id string) {
+		if _, ok := nodes[id]; ok {
+			return
+		}
+		score := neutralTrustScore
+		if seed != nil {
+			if v, ok := seed(id, dimension); ok {
+				score = v
 			}
 		}
+		nodes[id] = &nodeState{score: score}
+	}
+
+	for _, att := range attestations {
+		adjacency[att.SubjectID] = append(adjacency[att.SubjectID], att)
+		ensureNode(att.SubjectID)
+		ensureNode(att.AttestorID)
+	}
+
+	subjects := make([]string, 0, len(adjacency))
+	for subjectID := range adjacency {
+		subjects = append(subjects, subjectID)
 	}
 
-	return results, nil
+	round := 0
+	for ; round < convergeMaxRounds; round++ {
+		if allConverged(subjects, nodes) {
+			break
+		}
+		now := time.Now()
+		sampled := make(map[string]float64, len(subjects))
+		for _, subjectID := range subjects {
+			if nodes[subjectID].converged {
+				continue
+			}
+			sampled[subjectID] = sampleWeightedMean(adjacency[subjectID], nodes, now)
+		}
+		for subjectID, mean := range sampled {
+			node := nodes[subjectID]
+			updated := convergeAlpha*mean + (1-convergeAlpha)*node.score
+			delta := math.Abs(updated - node.score)
+			node.score = updated
+			if delta < convergeEpsilon {
+				node.confidence++
+				if node.confidence >= convergeBeta {
+					node.converged = true
+				}
+			} else {
+				node.confidence = 0
+			}
+		}
+	}
+
+	return subjects, nodes, round
+}
+
+// sampleWeightedMean draws up to convergeSampleSize attestors from
+// candidates and returns the mean of their values, weighted by each
+// attestor's current score and by time-decay on how stale the attestation
+// is. A candidate pool no larger than convergeSampleSize is used in full
+// rather than sampled with replacement, so small graphs converge on the
+// exact weighted mean instead of chasing sampling noise round after round.
+func sampleWeightedMean(candidates []Attestation, nodes map[string]*nodeState, now time.Time) float64 {
+	var weightedSum, weightSum float64
+	accumulate := func(att Attestation) {
+		decay := math.Exp(-convergeDecayLambda * now.Sub(att.Timestamp).Hours())
+		weight := nodes[att.AttestorID].score * decay
+		weightedSum += weight * att.Value
+		weightSum += weight
+	}
+
+	if len(candidates) <= convergeSampleSize {
+		for _, att := range candidates {
+			accumulate(att)
+		}
+	} else {
+		for i := 0; i < convergeSampleSize; i++ {
+			accumulate(candidates[rand.Intn(len(candidates))])
+		}
+	}
+
+	if weightSum == 0 {
+		return neutralTrustScore
+	}
+	return weightedSum / weightSum
+}
+
+func allConverged(subjects []string, nodes map[string]*nodeState) bool {
+	for _, id := range subjects {
+		if !nodes[id].converged {
+			return false
+		}
+	}
+	return true
 }
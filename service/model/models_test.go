@@ -0,0 +1,120 @@
+package model
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/icook/tiny-congress/db"
+	"github.com/icook/tiny-congress/storage/mem"
+)
+
+func newTestTrustGraph(t *testing.T) *TrustGraphImpl {
+	t.Helper()
+	graph, err := NewTrustGraph(nil, "test-graph")
+	if err != nil {
+		t.Fatalf("NewTrustGraph: %v", err)
+	}
+	return graph
+}
+
+func TestConvergeTrustGraphTrustedClusterOutweighsLargerLowTrustCluster(t *testing.T) {
+	graph := newTestTrustGraph(t)
+
+	seed := func(nodeID, dimension string) (float64, bool) {
+		switch nodeID {
+		case "trusted-1", "trusted-2", "trusted-3":
+			return 0.9, true
+		default:
+			return 0.1, true
+		}
+	}
+
+	// Three highly-trusted attestors all agree the subject is trustworthy...
+	for _, attestor := range []string{"trusted-1", "trusted-2", "trusted-3"} {
+		if err := graph.AddAttestation(attestor, "subject", "reliability", 0.9, nil); err != nil {
+			t.Fatalf("AddAttestation(%s): %v", attestor, err)
+		}
+	}
+	// ...while a larger cluster of low-trust attestors disagrees.
+	for i := 0; i < 10; i++ {
+		attestor := fmt.Sprintf("untrusted-%d", i)
+		if err := graph.AddAttestation(attestor, "subject", "reliability", 0.1, nil); err != nil {
+			t.Fatalf("AddAttestation(%s): %v", attestor, err)
+		}
+	}
+
+	result, err := graph.ConvergeTrustGraph(seed)
+	if err != nil {
+		t.Fatalf("ConvergeTrustGraph: %v", err)
+	}
+
+	score := result.Scores["subject"]["reliability"]
+	naiveAverage := (3*0.9 + 10*0.1) / 13.0
+	if score <= naiveAverage {
+		t.Fatalf("expected trust-weighted score (%v) to beat the naive unweighted average (%v) given the larger low-trust cluster", score, naiveAverage)
+	}
+	if !result.Converged["subject"]["reliability"] {
+		t.Fatalf("expected subject to converge within %d rounds", convergeMaxRounds)
+	}
+}
+
+func TestConvergeTrustGraphSeedsNeutralScoreWithoutSeedFunc(t *testing.T) {
+	graph := newTestTrustGraph(t)
+	if err := graph.AddAttestation("attestor", "subject", "reliability", 0.8, nil); err != nil {
+		t.Fatalf("AddAttestation: %v", err)
+	}
+
+	result, err := graph.ConvergeTrustGraph(nil)
+	if err != nil {
+		t.Fatalf("ConvergeTrustGraph: %v", err)
+	}
+
+	if _, ok := result.Scores["subject"]["reliability"]; !ok {
+		t.Fatal("expected a converged score for subject/reliability")
+	}
+	if !result.Converged["subject"]["reliability"] {
+		t.Fatal("expected subject to converge with a single consistent attestor")
+	}
+}
+
+// TestNewTrustGraphRestoresAttestationsAfterRestart confirms attestations
+// added through one TrustGraphImpl survive a simulated restart: a second
+// TrustGraphImpl built against the same store/graphID picks them up via
+// NewTrustGraph, without ConvergeTrustGraph needing them re-added.
+func TestNewTrustGraphRestoresAttestationsAfterRestart(t *testing.T) {
+	store, err := db.NewPersistenceLayer(mem.NewMemStore(), unregisteredTypeEngine{})
+	if err != nil {
+		t.Fatalf("NewPersistenceLayer: %v", err)
+	}
+
+	graph, err := NewTrustGraph(store, "restart-graph")
+	if err != nil {
+		t.Fatalf("NewTrustGraph: %v", err)
+	}
+	if err := graph.AddAttestation("attestor", "subject", "reliability", 0.8, nil); err != nil {
+		t.Fatalf("AddAttestation: %v", err)
+	}
+
+	restarted, err := NewTrustGraph(store, "restart-graph")
+	if err != nil {
+		t.Fatalf("NewTrustGraph after restart: %v", err)
+	}
+
+	result, err := restarted.ConvergeTrustGraph(nil)
+	if err != nil {
+		t.Fatalf("ConvergeTrustGraph: %v", err)
+	}
+	if _, ok := result.Scores["subject"]["reliability"]; !ok {
+		t.Fatal("expected the restored attestation to produce a converged score for subject/reliability")
+	}
+}
+
+// unregisteredTypeEngine models a realistic db.TypeEngine: one that has
+// never heard of "trust_graph" and refuses to guess a ruleset for it -
+// TrustGraphImpl's persistence must bypass it via WriteRaw rather than
+// UpdateKey, or this panics.
+type unregisteredTypeEngine struct{}
+
+func (unregisteredTypeEngine) GetRuleset(valueType string) db.TypeRuleset {
+	panic(fmt.Sprintf("no ruleset registered for valueType %q", valueType))
+}
@@ -2,18 +2,25 @@ package mem
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/icook/tiny-congress/db"
 )
 
-var _ db.StorageDriver = Store{}
+var _ db.StorageDriver = &Store{}
+var _ db.CASDriver = &Store{}
 
 type storeObj struct {
 	data []byte
+	rev  db.ResourceVersion
 }
 
-// Store implements a minimal in memory StorageDriver for unit testing
+// Store implements a minimal in memory StorageDriver for unit testing. It
+// also implements db.CASDriver, backing GuaranteedUpdate's compare-and-swap
+// with a monotonically incrementing per-key revision counter rather than
+// PersistenceLayer's client-side fallback.
 type Store struct {
+	mu    sync.Mutex
 	store map[string]storeObj
 }
 
@@ -23,17 +30,48 @@ func NewMemStore() *Store {
 	}
 }
 
-func (m Store) WriteKey(key string, data []byte) error {
+func (m *Store) WriteKey(key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.store[key] = storeObj{
 		data: data,
+		rev:  m.store[key].rev + 1,
 	}
 	return nil
 }
 
-func (m Store) GetKey(key string) ([]byte, error) {
+func (m *Store) GetKey(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	obj, found := m.store[key]
 	if !found {
 		return nil, errors.New("not found")
 	}
 	return obj.data, nil
 }
+
+func (m *Store) GetKeyWithRevision(key string) ([]byte, db.ResourceVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, found := m.store[key]
+	if !found {
+		return nil, 0, nil
+	}
+	return obj.data, obj.rev, nil
+}
+
+// ErrIsNotFound reports whether err is the "not found" sentinel GetKey
+// returns for a missing key, satisfying db.NotFoundChecker.
+func (m *Store) ErrIsNotFound(err error) bool {
+	return err != nil && err.Error() == "not found"
+}
+
+func (m *Store) CompareAndSwap(key string, expectedRev, newRev db.ResourceVersion, data []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.store[key].rev != expectedRev {
+		return false, nil
+	}
+	m.store[key] = storeObj{data: data, rev: newRev}
+	return true, nil
+}
@@ -0,0 +1,599 @@
+package election
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/icook/tiny-congress/db"
+)
+
+// RoundPhase is the Tendermint-style phase an in-progress Round is in.
+type RoundPhase string
+
+const (
+	PhasePropose   RoundPhase = "propose"
+	PhasePrevote   RoundPhase = "prevote"
+	PhasePrecommit RoundPhase = "precommit"
+	PhaseCommit    RoundPhase = "commit"
+)
+
+// RulesetRegistry resolves the RoundRuleset a RoundConfig names. It mirrors
+// db.TypeEngine's GetRuleset pattern for the election package's own notion
+// of a pluggable ruleset.
+type RulesetRegistry interface {
+	GetRoundRuleset(name string) (RoundRuleset, bool)
+}
+
+// EventType identifies the kind of change an Engine reports on its events
+// channel.
+type EventType string
+
+const (
+	EventPhaseChanged     EventType = "phase_changed"
+	EventElectionRatified EventType = "ratified"
+	EventElectionRejected EventType = "rejected"
+)
+
+// Event is a notification an Engine emits as it drives an election through
+// its rounds, meant for poll watchers or an API layer to subscribe to.
+type Event struct {
+	Type       EventType
+	ElectionID string
+	RoundIndex int
+	Phase      RoundPhase
+	Time       time.Time
+}
+
+// Engine drives a single Election's rounds to completion: it runs each
+// RoundConfig in sequence through a Propose -> Prevote -> Precommit -> Commit
+// cycle, collects ballots via SubmitBallot, and consults the round's
+// RoundRuleset during precommit to decide whether the round (and therefore
+// the election) ratifies, rejects, extends, or times out inconclusively into
+// the next round.
+type Engine struct {
+	id            string
+	config        ElectionConfig
+	registry      RulesetRegistry
+	store         *db.PersistenceLayer
+	maxExtensions int
+	events        chan Event
+
+	mu       sync.Mutex
+	status   ElectionStatus
+	current  *engineRound
+	rounds   []*engineRound
+	restored *engineRound
+}
+
+// NewEngine builds an Engine for a single election run. store may be nil, in
+// which case round transitions simply aren't persisted (useful for tests
+// that don't care about restart recovery). If store isn't nil, NewEngine
+// looks for a round snapshot left by a prior, crashed run of this same
+// election id; if one is found, Run resumes that round instead of starting
+// over from round 0.
+func NewEngine(id string, config ElectionConfig, registry RulesetRegistry, store *db.PersistenceLayer, maxExtensions int) *Engine {
+	e := &Engine{
+		id:            id,
+		config:        config,
+		registry:      registry,
+		store:         store,
+		maxExtensions: maxExtensions,
+		status:        ElectionStatusInProgress,
+		events:        make(chan Event, 64),
+	}
+	if store != nil {
+		e.restored = e.loadRound()
+	}
+	return e
+}
+
+// Events returns the channel Engine publishes phase and outcome
+// notifications to. It is never closed by Run.
+func (e *Engine) Events() <-chan Event {
+	return e.events
+}
+
+// Status reports the election's current, possibly still in-progress, status.
+func (e *Engine) Status() ElectionStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.status
+}
+
+// Rounds returns the rounds run so far, including the in-progress one.
+func (e *Engine) Rounds() []Round {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]Round, len(e.rounds))
+	for i, r := range e.rounds {
+		out[i] = r
+	}
+	return out
+}
+
+// SubmitBallot hands a ballot to whichever round is currently in progress.
+// Token types the current round's ruleset doesn't list in
+// RelevantTokenTypes() are dropped before the ballot is stored, so later
+// tallying never has to re-filter.
+func (e *Engine) SubmitBallot(ballot Ballot) error {
+	e.mu.Lock()
+	round := e.current
+	e.mu.Unlock()
+	if round == nil {
+		return errors.New("election: no round in progress to accept ballots")
+	}
+
+	ruleset, ok := e.registry.GetRoundRuleset(round.cfg.RoundRulesetName)
+	if !ok {
+		return errors.Errorf("election: unknown round ruleset %q", round.cfg.RoundRulesetName)
+	}
+
+	allowed := make(map[TokenTypeCode]bool, len(ruleset.RelevantTokenTypes()))
+	for _, tt := range ruleset.RelevantTokenTypes() {
+		allowed[TokenTypeCode(tt)] = true
+	}
+	relevant := make(map[TokenTypeCode]float64)
+	for tt, amount := range ballot.TokensCast() {
+		if allowed[tt] {
+			relevant[tt] = amount
+		}
+	}
+
+	round.addBallot(filteredBallot{
+		identity:     ballot.Identity(),
+		declaredTime: ballot.DeclaredTime(),
+		tokens:       relevant,
+	})
+	return nil
+}
+
+// ErrTopicOnRetryHold is returned by Run when a prior rejection of this
+// election's topic recorded a RetryAfter that hasn't elapsed yet - the
+// enforcement side of recordRetryAfter's promise to block re-motions on the
+// same topic.
+var ErrTopicOnRetryHold = errors.New("election: topic is on retry hold")
+
+// Run drives the election's configured rounds to completion, or until ctx is
+// cancelled. It returns nil once the election reaches ElectionStatusRatified
+// or ElectionStatusRejected (or runs out of rounds, which is treated as a
+// rejection), and otherwise returns ctx's error. It refuses to start at all
+// if the election's topic is still on a RetryAfter hold from an earlier
+// rejection, returning ErrTopicOnRetryHold. If NewEngine found a round
+// snapshot from a prior crashed run, Run resumes that round instead of
+// starting over from round 0.
+func (e *Engine) Run(ctx context.Context) error {
+	blocked, retryAfter, err := e.checkRetryAfter()
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errors.Wrapf(ErrTopicOnRetryHold, "until %s", retryAfter.Format(time.RFC3339))
+	}
+
+	rounds := e.config.Rounds()
+	startIdx := 0
+	if e.restored != nil {
+		startIdx = e.restored.idx
+	}
+
+	for idx := startIdx; idx < len(rounds); idx++ {
+		outcome, err := e.runRound(ctx, idx, rounds[idx])
+		if err != nil {
+			return err
+		}
+		switch outcome {
+		case ElectionStatusRatified:
+			e.finish(ElectionStatusRatified)
+			return nil
+		case ElectionStatusRejected:
+			e.finish(ElectionStatusRejected)
+			return nil
+		}
+		// Inconclusive: fall through to the next configured round.
+	}
+	// Ran out of rounds without anyone ratifying - treat as rejected rather
+	// than leaving the election stuck in progress forever.
+	e.finish(ElectionStatusRejected)
+	return nil
+}
+
+// checkRetryAfter reports whether e.config.Name()'s topic is still within a
+// RetryAfter window recorded by a previous rejection.
+func (e *Engine) checkRetryAfter() (blocked bool, retryAfter time.Time, err error) {
+	if e.store == nil {
+		return false, time.Time{}, nil
+	}
+	data, _, err := e.store.FetchRaw(topicIdentifier{topic: e.config.Name()}, "election_retry")
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if len(data) == 0 {
+		return false, time.Time{}, nil
+	}
+	retryAfter, err = time.Parse(time.RFC3339, string(data))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return time.Now().Before(retryAfter), retryAfter, nil
+}
+
+func (e *Engine) finish(status ElectionStatus) {
+	e.mu.Lock()
+	e.status = status
+	e.mu.Unlock()
+	evt := EventElectionRatified
+	if status == ElectionStatusRejected {
+		evt = EventElectionRejected
+	}
+	e.emit(Event{Type: evt, ElectionID: e.id, Time: time.Now()})
+}
+
+func (e *Engine) runRound(ctx context.Context, idx int, rc RoundConfig) (ElectionStatus, error) {
+	ruleset, ok := e.registry.GetRoundRuleset(rc.RoundRulesetName)
+	if !ok {
+		return "", errors.Errorf("election: unknown round ruleset %q", rc.RoundRulesetName)
+	}
+
+	round := e.takeRestoredRound(idx)
+	if round == nil {
+		round = newEngineRound(idx, rc)
+	}
+	e.mu.Lock()
+	e.current = round
+	e.rounds = append(e.rounds, round)
+	e.mu.Unlock()
+
+	// Propose and Prevote are fixed windows; Precommit runs until the
+	// ruleset renders a verdict or the (possibly extended) deadline passes.
+	slice := rc.BaseDuration / 4
+	deadline := round.startTime.Add(rc.BaseDuration)
+
+	// A round resumed from a snapshot already got past Propose in its
+	// previous life - IsRatified/IsRejected are pure functions of its
+	// restored ballots, so jumping straight to Precommit re-derives the
+	// same verdict the crashed run would have reached, without replaying
+	// windows that have no bearing on that verdict.
+	if round.currentPhase() == PhasePropose {
+		if err := e.advance(ctx, round, PhasePropose, slice); err != nil {
+			return "", err
+		}
+		if err := e.advance(ctx, round, PhasePrevote, slice); err != nil {
+			return "", err
+		}
+	}
+	e.transition(round, PhasePrecommit)
+
+	extensions := 0
+	for {
+		ballots := round.ballotsSnapshot()
+
+		if ruleset.IsRatified(ballots) {
+			e.transition(round, PhaseCommit)
+			return ElectionStatusRatified, nil
+		}
+		if retry := ruleset.IsRejected(ballots); retry != nil {
+			e.recordRetryAfter(retry)
+			e.transition(round, PhaseCommit)
+			return ElectionStatusRejected, nil
+		}
+		if ext := ruleset.IsExtended(ballots); ext != nil && extensions < e.maxExtensions {
+			extensions++
+			deadline = deadline.Add(ext.Duration())
+			e.transition(round, PhasePrevote)
+			if err := e.waitUntil(ctx, round, deadline); err != nil {
+				return "", err
+			}
+			e.transition(round, PhasePrecommit)
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			// Ran out of time (or extensions) without a verdict - move on
+			// to the next configured round rather than stalling here.
+			e.transition(round, PhaseCommit)
+			return "", nil
+		}
+		if err := e.waitUntil(ctx, round, deadline); err != nil {
+			return "", err
+		}
+	}
+}
+
+// advance transitions round into phase and then waits out its duration.
+func (e *Engine) advance(ctx context.Context, round *engineRound, phase RoundPhase, d time.Duration) error {
+	e.transition(round, phase)
+	return e.sleep(ctx, d)
+}
+
+func (e *Engine) sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitUntil blocks until deadline, ctx is cancelled, or a ballot arrives for
+// round - whichever is first - so a ballot that tips the ruleset's verdict
+// is noticed well before the phase would otherwise time out.
+func (e *Engine) waitUntil(ctx context.Context, round *engineRound, deadline time.Time) error {
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-round.notify:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *Engine) transition(round *engineRound, phase RoundPhase) {
+	round.setPhase(phase)
+	e.persistRound(round)
+	e.emit(Event{
+		Type:       EventPhaseChanged,
+		ElectionID: e.id,
+		RoundIndex: round.idx,
+		Phase:      phase,
+		Time:       time.Now(),
+	})
+}
+
+func (e *Engine) emit(evt Event) {
+	select {
+	case e.events <- evt:
+	default:
+		// Events channel is just a convenience for subscribers - a slow or
+		// absent reader shouldn't stall the election.
+	}
+}
+
+// persistedRound is the JSON shape an engineRound is snapshotted as, so a
+// restarted process can resume mid-election: NewEngine loads the latest
+// snapshot for this election id, and Run resumes the in-flight round from
+// its last known phase and ballots instead of starting over from round 0.
+type persistedRound struct {
+	RoundIndex int               `json:"round_index"`
+	Phase      RoundPhase        `json:"phase"`
+	StartTime  time.Time         `json:"start_time"`
+	Ballots    []persistedBallot `json:"ballots"`
+}
+
+// persistedBallot is the JSON-safe shape of a filteredBallot.
+type persistedBallot struct {
+	IdentityID   uuid.UUID                 `json:"identity_id"`
+	DeclaredTime time.Time                 `json:"declared_time"`
+	Tokens       map[TokenTypeCode]float64 `json:"tokens"`
+}
+
+func (e *Engine) persistRound(round *engineRound) {
+	if e.store == nil {
+		return
+	}
+	ballots := round.ballotsSnapshot()
+	persistedBallots := make([]persistedBallot, len(ballots))
+	for i, b := range ballots {
+		persistedBallots[i] = persistedBallot{
+			IdentityID:   b.Identity().ID(),
+			DeclaredTime: b.DeclaredTime(),
+			Tokens:       b.TokensCast(),
+		}
+	}
+	snapshot := persistedRound{
+		RoundIndex: round.idx,
+		Phase:      round.currentPhase(),
+		StartTime:  round.startTime,
+		Ballots:    persistedBallots,
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return
+	}
+	// Best-effort: a failure to persist a round snapshot shouldn't abort an
+	// otherwise-healthy election, just degrade restart recovery. This is our
+	// own internal checkpoint, not a type-governed value, so it bypasses
+	// TypeRuleset via WriteRaw rather than UpdateKey.
+	_ = e.store.WriteRaw(electionIdentifier{electionID: e.id}, "election_round", data)
+}
+
+// loadRound fetches this election id's last persisted round snapshot, if
+// any, so Run can resume mid-round rather than starting over from round 0.
+// Best-effort: any error, missing snapshot, or a RoundIndex the current
+// config no longer has is treated the same as "nothing to resume".
+func (e *Engine) loadRound() *engineRound {
+	data, _, err := e.store.FetchRaw(electionIdentifier{electionID: e.id}, "election_round")
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var snapshot persistedRound
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil
+	}
+	rounds := e.config.Rounds()
+	if snapshot.RoundIndex < 0 || snapshot.RoundIndex >= len(rounds) {
+		return nil
+	}
+	return &engineRound{
+		idx:       snapshot.RoundIndex,
+		cfg:       rounds[snapshot.RoundIndex],
+		startTime: snapshot.StartTime,
+		notify:    make(chan struct{}, 1),
+		phase:     snapshot.Phase,
+		ballots:   fromPersistedBallots(snapshot.Ballots),
+	}
+}
+
+// takeRestoredRound returns and clears e.restored if it matches idx, so a
+// round snapshot resumed from a prior run is only ever used once.
+func (e *Engine) takeRestoredRound(idx int) *engineRound {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.restored != nil && e.restored.idx == idx {
+		round := e.restored
+		e.restored = nil
+		return round
+	}
+	return nil
+}
+
+func fromPersistedBallots(in []persistedBallot) []Ballot {
+	out := make([]Ballot, len(in))
+	for i, pb := range in {
+		out[i] = filteredBallot{
+			identity:     restoredIdentity{id: pb.IdentityID},
+			declaredTime: pb.DeclaredTime,
+			tokens:       pb.Tokens,
+		}
+	}
+	return out
+}
+
+// restoredIdentity satisfies Identity for a ballot rehydrated from a
+// persisted round snapshot - only the original signer's uuid survives the
+// round trip.
+type restoredIdentity struct{ id uuid.UUID }
+
+func (r restoredIdentity) ID() uuid.UUID { return r.id }
+
+// recordRetryAfter blocks re-motions on this election's topic until retry has
+// elapsed. It's keyed by e.config.Name() (the topic), not e.id (this run) -
+// a future motion on the same topic runs through a new Engine with a new
+// id, so only a topic-scoped key lets that Engine find this record.
+func (e *Engine) recordRetryAfter(retry RetryOption) {
+	if e.store == nil {
+		return
+	}
+	retryAfter := time.Now().Add(retry.RetryAfter())
+	_ = e.store.WriteRaw(topicIdentifier{topic: e.config.Name()}, "election_retry", []byte(retryAfter.Format(time.RFC3339)))
+}
+
+// electionIdentifier satisfies db.Identifier so Engine can persist through
+// the shared PersistenceLayer under a "election.<name>#<id>" style key.
+type electionIdentifier struct {
+	electionID string
+}
+
+func (i electionIdentifier) Pairs() map[string]string {
+	return map[string]string{"election_id": i.electionID}
+}
+func (i electionIdentifier) Key() string  { return i.electionID }
+func (i electionIdentifier) Name() string { return "election" }
+
+// topicIdentifier satisfies db.Identifier for records scoped to an election
+// topic (ElectionConfig.Name()) rather than to one run of it, so they
+// outlive the Engine that wrote them.
+type topicIdentifier struct {
+	topic string
+}
+
+func (i topicIdentifier) Pairs() map[string]string { return map[string]string{"topic": i.topic} }
+func (i topicIdentifier) Key() string              { return i.topic }
+func (i topicIdentifier) Name() string             { return "election_topic" }
+
+// filteredBallot is the internal copy of a submitted Ballot, holding only
+// the token types the round's ruleset cares about.
+type filteredBallot struct {
+	identity     Identity
+	declaredTime time.Time
+	tokens       map[TokenTypeCode]float64
+}
+
+func (b filteredBallot) Identity() Identity                    { return b.identity }
+func (b filteredBallot) DeclaredTime() time.Time               { return b.declaredTime }
+func (b filteredBallot) TokensCast() map[TokenTypeCode]float64 { return b.tokens }
+
+// engineRound is Engine's implementation of the Round interface.
+type engineRound struct {
+	idx       int
+	cfg       RoundConfig
+	startTime time.Time
+	notify    chan struct{}
+
+	mu      sync.Mutex
+	phase   RoundPhase
+	ballots []Ballot
+}
+
+func newEngineRound(idx int, cfg RoundConfig) *engineRound {
+	return &engineRound{
+		idx:       idx,
+		cfg:       cfg,
+		startTime: time.Now(),
+		notify:    make(chan struct{}, 1),
+		phase:     PhasePropose,
+	}
+}
+
+func (r *engineRound) ID() string { return fmt.Sprintf("%d", r.idx) }
+
+// Ruleset satisfies the pre-existing (and, confusingly, RoundExtension-typed)
+// Round.Ruleset() method. Engine doesn't use round-level extensions this
+// way - RoundExtension comes from the RoundRuleset's IsExtended() - so this
+// always reports no extension.
+func (r *engineRound) Ruleset() RoundExtension { return noExtension{} }
+
+func (r *engineRound) Ballots() []Ballot { return r.ballotsSnapshot() }
+
+func (r *engineRound) TokensCast() map[TokenTypeCode]float64 {
+	totals := make(map[TokenTypeCode]float64)
+	for _, b := range r.ballotsSnapshot() {
+		for tt, amount := range b.TokensCast() {
+			totals[tt] += amount
+		}
+	}
+	return totals
+}
+
+func (r *engineRound) StartTime() time.Time { return r.startTime }
+
+func (r *engineRound) addBallot(b Ballot) {
+	r.mu.Lock()
+	r.ballots = append(r.ballots, b)
+	r.mu.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (r *engineRound) ballotsSnapshot() []Ballot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]Ballot, len(r.ballots))
+	copy(out, r.ballots)
+	return out
+}
+
+func (r *engineRound) setPhase(phase RoundPhase) {
+	r.mu.Lock()
+	r.phase = phase
+	r.mu.Unlock()
+}
+
+func (r *engineRound) currentPhase() RoundPhase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.phase
+}
+
+type noExtension struct{}
+
+func (noExtension) Duration() time.Duration { return 0 }
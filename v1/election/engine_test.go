@@ -0,0 +1,360 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/icook/tiny-congress/db"
+	"github.com/icook/tiny-congress/storage/mem"
+)
+
+type testIdentity struct{ id uuid.UUID }
+
+func (t testIdentity) ID() uuid.UUID { return t.id }
+
+type testBallot struct {
+	identity Identity
+	tokens   map[TokenTypeCode]float64
+}
+
+func (b testBallot) Identity() Identity                    { return b.identity }
+func (b testBallot) DeclaredTime() time.Time               { return time.Now() }
+func (b testBallot) TokensCast() map[TokenTypeCode]float64 { return b.tokens }
+
+func newTestBallot(weight float64) Ballot {
+	return testBallot{
+		identity: testIdentity{id: uuid.New()},
+		tokens:   map[TokenTypeCode]float64{"vote": weight},
+	}
+}
+
+type testElectionConfig struct {
+	rounds []RoundConfig
+}
+
+func (c testElectionConfig) Name() string          { return "test-election" }
+func (c testElectionConfig) Rounds() []RoundConfig { return c.rounds }
+
+const testRoundDuration = 40 * time.Millisecond
+
+func runEngine(t *testing.T, ruleset RoundRuleset, maxExtensions int) (*Engine, error) {
+	t.Helper()
+	cfg := testElectionConfig{rounds: []RoundConfig{
+		{RoundRulesetName: ruleset.Name(), BaseDuration: testRoundDuration},
+	}}
+	registry := NewRulesetRegistry(map[string]RoundRuleset{ruleset.Name(): ruleset})
+	engine := NewEngine("test", cfg, registry, nil, maxExtensions)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := engine.Run(ctx)
+	return engine, err
+}
+
+func TestEngineTimeoutWithoutRatificationRejects(t *testing.T) {
+	// No ballot ever satisfies IsRatified, so the round simply times out
+	// inconclusively and, being the only configured round, the election is
+	// treated as rejected.
+	ruleset := MockRuleset{NameValue: "timeout-only", RelevantTypes: []string{"vote"}}
+	engine, err := runEngine(t, ruleset, 0)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := engine.Status(); got != ElectionStatusRejected {
+		t.Fatalf("expected %s, got %s", ElectionStatusRejected, got)
+	}
+}
+
+func TestEngineEarlyRatification(t *testing.T) {
+	ruleset := MockRuleset{
+		NameValue:     "early-ratify",
+		RelevantTypes: []string{"vote"},
+		RatifiedFn: func(ballots []Ballot) bool {
+			var total float64
+			for _, b := range ballots {
+				total += b.TokensCast()["vote"]
+			}
+			return total >= 3
+		},
+	}
+
+	cfg := testElectionConfig{rounds: []RoundConfig{
+		{RoundRulesetName: ruleset.Name(), BaseDuration: testRoundDuration},
+	}}
+	registry := NewRulesetRegistry(map[string]RoundRuleset{ruleset.Name(): ruleset})
+	engine := NewEngine("test", cfg, registry, nil, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- engine.Run(ctx) }()
+
+	// Give Propose/Prevote a moment to elapse so SubmitBallot lands during
+	// Precommit, then submit enough weight to ratify well before the
+	// round's deadline.
+	time.Sleep(testRoundDuration / 2)
+	if err := engine.SubmitBallot(newTestBallot(3)); err != nil {
+		t.Fatalf("SubmitBallot: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("election did not conclude before the timeout")
+	}
+
+	if got := engine.Status(); got != ElectionStatusRatified {
+		t.Fatalf("expected %s, got %s", ElectionStatusRatified, got)
+	}
+}
+
+func TestEngineExtensionChainCapsAtMaxExtensions(t *testing.T) {
+	const maxExtensions = 2
+	extensions := 0
+	ruleset := MockRuleset{
+		NameValue:     "always-extend",
+		RelevantTypes: []string{"vote"},
+		ExtendedFn: func(ballots []Ballot) RoundExtension {
+			extensions++
+			return FixedRoundExtension(5 * time.Millisecond)
+		},
+	}
+	engine, err := runEngine(t, ruleset, maxExtensions)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// Never ratifies or rejects, so once extensions are exhausted the round
+	// times out inconclusively and the (sole) round's election is rejected.
+	if got := engine.Status(); got != ElectionStatusRejected {
+		t.Fatalf("expected %s, got %s", ElectionStatusRejected, got)
+	}
+	if extensions <= maxExtensions {
+		t.Fatalf("expected IsExtended to be consulted beyond maxExtensions=%d, only saw %d calls", maxExtensions, extensions)
+	}
+}
+
+func TestEngineRejectionWithRetryOptionRejects(t *testing.T) {
+	ruleset := MockRuleset{
+		NameValue:     "reject",
+		RelevantTypes: []string{"vote"},
+		RejectedFn: func(ballots []Ballot) RetryOption {
+			return FixedRetryOption(time.Hour)
+		},
+	}
+	engine, err := runEngine(t, ruleset, 0)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := engine.Status(); got != ElectionStatusRejected {
+		t.Fatalf("expected %s, got %s", ElectionStatusRejected, got)
+	}
+}
+
+// TestEngineRejectionPersistsRetryAfterByTopic confirms recordRetryAfter is
+// keyed by the election's topic (ElectionConfig.Name()) rather than its run
+// id - a later motion on the same topic runs through a brand new Engine
+// with a different id, so only a topic-scoped key lets it find the record.
+// It also uses a TypeEngine that panics on any GetRuleset call, proving the
+// write goes through WriteRaw rather than UpdateKey.
+func TestEngineRejectionPersistsRetryAfterByTopic(t *testing.T) {
+	store, err := db.NewPersistenceLayer(mem.NewMemStore(), unregisteredTypeEngine{})
+	if err != nil {
+		t.Fatalf("NewPersistenceLayer: %v", err)
+	}
+
+	ruleset := MockRuleset{
+		NameValue:     "reject",
+		RelevantTypes: []string{"vote"},
+		RejectedFn: func(ballots []Ballot) RetryOption {
+			return FixedRetryOption(time.Hour)
+		},
+	}
+	cfg := testElectionConfig{rounds: []RoundConfig{
+		{RoundRulesetName: ruleset.Name(), BaseDuration: testRoundDuration},
+	}}
+	registry := NewRulesetRegistry(map[string]RoundRuleset{ruleset.Name(): ruleset})
+
+	firstRun := NewEngine("first-run-id", cfg, registry, store, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := firstRun.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := firstRun.Status(); got != ElectionStatusRejected {
+		t.Fatalf("expected %s, got %s", ElectionStatusRejected, got)
+	}
+
+	// A re-motion on the same topic is a brand new Engine with a different
+	// run id - only the topic-scoped key lets it see the earlier rejection.
+	data, _, err := store.FetchRaw(topicIdentifier{topic: cfg.Name()}, "election_retry")
+	if err != nil {
+		t.Fatalf("FetchRaw: %v", err)
+	}
+	if len(data) == 0 {
+		t.Fatal("expected a retry-after record under the election's topic key")
+	}
+}
+
+// unregisteredTypeEngine models a realistic db.TypeEngine: one that has
+// never heard of "election_round"/"election_retry" and refuses to guess a
+// ruleset for them - persistRound/recordRetryAfter must bypass it via
+// WriteRaw rather than UpdateKey, or this panics.
+type unregisteredTypeEngine struct{}
+
+func (unregisteredTypeEngine) GetRuleset(valueType string) db.TypeRuleset {
+	panic(fmt.Sprintf("no ruleset registered for valueType %q", valueType))
+}
+
+// TestEngineRefusesMotionDuringRetryHold confirms Run actually enforces the
+// RetryAfter record recordRetryAfter writes: a later motion on the same
+// topic - a brand new Engine with a different run id - must refuse to run
+// at all until the hold elapses, not just leave an unread record behind.
+func TestEngineRefusesMotionDuringRetryHold(t *testing.T) {
+	store, err := db.NewPersistenceLayer(mem.NewMemStore(), unregisteredTypeEngine{})
+	if err != nil {
+		t.Fatalf("NewPersistenceLayer: %v", err)
+	}
+
+	ruleset := MockRuleset{
+		NameValue:     "reject",
+		RelevantTypes: []string{"vote"},
+		RejectedFn: func(ballots []Ballot) RetryOption {
+			return FixedRetryOption(time.Hour)
+		},
+	}
+	cfg := testElectionConfig{rounds: []RoundConfig{
+		{RoundRulesetName: ruleset.Name(), BaseDuration: testRoundDuration},
+	}}
+	registry := NewRulesetRegistry(map[string]RoundRuleset{ruleset.Name(): ruleset})
+
+	firstRun := NewEngine("first-run-id", cfg, registry, store, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := firstRun.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := firstRun.Status(); got != ElectionStatusRejected {
+		t.Fatalf("expected %s, got %s", ElectionStatusRejected, got)
+	}
+
+	secondRun := NewEngine("second-run-id", cfg, registry, store, 0)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel2()
+	err = secondRun.Run(ctx2)
+	if errors.Cause(err) != ErrTopicOnRetryHold {
+		t.Fatalf("expected ErrTopicOnRetryHold, got %v", err)
+	}
+	if got := secondRun.Status(); got != ElectionStatusInProgress {
+		t.Fatalf("expected the held motion to never conclude, got %s", got)
+	}
+}
+
+// TestEngineResumesRoundAfterRestart confirms a fresh Engine built against
+// the same store/id as a crashed run picks up its persisted round snapshot
+// (phase and ballots) via NewEngine, and Run resumes it directly at
+// Precommit instead of starting over from round 0.
+func TestEngineResumesRoundAfterRestart(t *testing.T) {
+	store, err := db.NewPersistenceLayer(mem.NewMemStore(), unregisteredTypeEngine{})
+	if err != nil {
+		t.Fatalf("NewPersistenceLayer: %v", err)
+	}
+
+	ruleset := MockRuleset{
+		NameValue:     "resume-ratify",
+		RelevantTypes: []string{"vote"},
+		RatifiedFn: func(ballots []Ballot) bool {
+			var total float64
+			for _, b := range ballots {
+				total += b.TokensCast()["vote"]
+			}
+			return total >= 3
+		},
+	}
+	cfg := testElectionConfig{rounds: []RoundConfig{
+		{RoundRulesetName: ruleset.Name(), BaseDuration: testRoundDuration},
+	}}
+	registry := NewRulesetRegistry(map[string]RoundRuleset{ruleset.Name(): ruleset})
+
+	// Simulate a process that crashed right after entering Prevote, having
+	// already accepted a ratifying ballot and persisted a snapshot of it.
+	crashed := NewEngine("resume-run", cfg, registry, store, 0)
+	crashed.current = &engineRound{
+		idx:       0,
+		cfg:       cfg.rounds[0],
+		startTime: time.Now(),
+		notify:    make(chan struct{}, 1),
+		phase:     PhasePrevote,
+	}
+	crashed.current.addBallot(newTestBallot(3))
+	crashed.persistRound(crashed.current)
+
+	restarted := NewEngine("resume-run", cfg, registry, store, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := restarted.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := restarted.Status(); got != ElectionStatusRatified {
+		t.Fatalf("expected the restored ballot to ratify immediately, got %s", got)
+	}
+}
+
+func TestSubmitBallotFiltersIrrelevantTokenTypes(t *testing.T) {
+	var seen map[TokenTypeCode]float64
+	ruleset := MockRuleset{
+		NameValue:     "filter-check",
+		RelevantTypes: []string{"vote"},
+		RatifiedFn: func(ballots []Ballot) bool {
+			if len(ballots) > 0 {
+				seen = ballots[0].TokensCast()
+			}
+			return len(ballots) > 0
+		},
+	}
+
+	cfg := testElectionConfig{rounds: []RoundConfig{
+		{RoundRulesetName: ruleset.Name(), BaseDuration: testRoundDuration},
+	}}
+	registry := NewRulesetRegistry(map[string]RoundRuleset{ruleset.Name(): ruleset})
+	engine := NewEngine("test", cfg, registry, nil, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go engine.Run(ctx)
+
+	time.Sleep(testRoundDuration / 2)
+	err := engine.SubmitBallot(testBallot{
+		identity: testIdentity{id: uuid.New()},
+		tokens:   map[TokenTypeCode]float64{"vote": 1, "reputation": 99},
+	})
+	if err != nil {
+		t.Fatalf("SubmitBallot: %v", err)
+	}
+
+	// Wait for the engine to conclude (it ratifies as soon as any ballot is
+	// seen) before inspecting what was recorded.
+	deadline := time.After(2 * time.Second)
+	for engine.Status() == ElectionStatusInProgress {
+		select {
+		case <-deadline:
+			t.Fatal("election did not conclude")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if _, ok := seen["reputation"]; ok {
+		t.Fatalf("expected irrelevant token type to be filtered out, got %v", seen)
+	}
+	if _, ok := seen["vote"]; !ok {
+		t.Fatalf("expected relevant token type to survive filtering, got %v", seen)
+	}
+}
@@ -0,0 +1,64 @@
+package election
+
+import "time"
+
+// MockRuleset is a RoundRuleset entirely driven by injected functions, for
+// tests that want to control exactly when a round ratifies, rejects, or
+// extends without standing up a real (eventually wasm-backed) ruleset.
+type MockRuleset struct {
+	NameValue     string
+	RelevantTypes []string
+	RatifiedFn    func([]Ballot) bool
+	RejectedFn    func([]Ballot) RetryOption
+	ExtendedFn    func([]Ballot) RoundExtension
+}
+
+func (m MockRuleset) Name() string                 { return m.NameValue }
+func (m MockRuleset) RelevantTokenTypes() []string { return m.RelevantTypes }
+
+func (m MockRuleset) IsRatified(ballots []Ballot) bool {
+	if m.RatifiedFn == nil {
+		return false
+	}
+	return m.RatifiedFn(ballots)
+}
+
+func (m MockRuleset) IsRejected(ballots []Ballot) RetryOption {
+	if m.RejectedFn == nil {
+		return nil
+	}
+	return m.RejectedFn(ballots)
+}
+
+func (m MockRuleset) IsExtended(ballots []Ballot) RoundExtension {
+	if m.ExtendedFn == nil {
+		return nil
+	}
+	return m.ExtendedFn(ballots)
+}
+
+// FixedRetryOption is a RetryOption with a constant RetryAfter, handy for
+// tests and simple rulesets alike.
+type FixedRetryOption time.Duration
+
+func (f FixedRetryOption) RetryAfter() time.Duration { return time.Duration(f) }
+
+// FixedRoundExtension is a RoundExtension with a constant Duration.
+type FixedRoundExtension time.Duration
+
+func (f FixedRoundExtension) Duration() time.Duration { return time.Duration(f) }
+
+// mapRegistry is a RulesetRegistry backed by a plain map, the shape tests
+// (and simple callers) need to satisfy RulesetRegistry.
+type mapRegistry map[string]RoundRuleset
+
+func (m mapRegistry) GetRoundRuleset(name string) (RoundRuleset, bool) {
+	r, ok := m[name]
+	return r, ok
+}
+
+// NewRulesetRegistry builds a RulesetRegistry from a name -> RoundRuleset
+// map, the common case until rulesets are resolved from the database.
+func NewRulesetRegistry(rulesets map[string]RoundRuleset) RulesetRegistry {
+	return mapRegistry(rulesets)
+}